@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HTTP API только для чтения, чтобы портал и Grafana не ходили в БД напрямую.
+// Все запросы - GET с токеном в заголовке "Authorization: Bearer <token>":
+//
+//	/api/v1/traffic   - трафик по интервалам времени, по пользователю или сайту
+//	/api/v1/top       - первые N пользователей, адресов, сайтов, MIME или статусов
+//	/api/v1/requests  - поиск исходных запросов с фильтрами и постраничным выводом
+//	/api/v1/proxies   - прокси и время их последней загрузки
+//
+// Период задаётся параметрами from и to: YYYY-MM-DD[ HH:MM], today, yesterday,
+// RFC 3339 или unix-время в секундах или миллисекундах. Без proxy - все прокси.
+
+type apiOptions struct {
+	addr       string
+	token      string
+	tokensFile string
+	rate       float64
+	burst      int
+	maxRows    int
+}
+
+func apiFlags(fs *flag.FlagSet, cfg *Config) {
+	opts := &cfg.api
+	fs.StringVar(&opts.addr, "api-addr", ":9121", "Address to serve the API on, or 'systemd' for socket activation")
+	fs.StringVar(&opts.token, "api-token", "", "Token of API clients")
+	fs.StringVar(&opts.tokensFile, "api-tokens", "", "File with API tokens, one per line")
+	fs.Float64Var(&opts.rate, "api-rate", 5, "Requests per second allowed for one token")
+	fs.IntVar(&opts.burst, "api-burst", 20, "Requests one token may make at once before -api-rate applies")
+	fs.IntVar(&opts.maxRows, "api-max-rows", 1000, "Maximum number of rows in one response")
+}
+
+func readTokens(opts *apiOptions) ([]string, error) {
+	var tokens []string
+	if opts.token != "" {
+		tokens = append(tokens, opts.token)
+	}
+	if opts.tokensFile != "" {
+		file, err := os.Open(opts.tokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error open tokens file(%v):%v", opts.tokensFile, err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && line[0] != '#' {
+				tokens = append(tokens, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Error. API without tokens is not served, set -api-token or -api-tokens")
+	}
+	return tokens, nil
+}
+
+// Неверные токены ограничиваются по адресу клиента: authFailBurst попыток
+// сразу, затем одна раз в 1/authFailRate секунд. Пока лимит исчерпан,
+// токен с этого адреса не проверяется вовсе.
+const (
+	authFailRate  = 0.1
+	authFailBurst = 10
+)
+
+// maxBuckets - после стольких ключей из limiter'а удаляются полные корзины,
+// чтобы перебор адресов не раздувал память.
+const maxBuckets = 10000
+
+// rateLimiter - token bucket на каждый ключ: токен API или адрес клиента.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	b := l.bucket(key, time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// exhausted сообщает, что лимит ключа исчерпан, не расходуя его.
+func (l *rateLimiter) exhausted(key string) bool {
+	if l.rate <= 0 {
+		return false
+	}
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		return false
+	}
+	l.refill(b, time.Now())
+	return b.tokens < 1
+}
+
+// bucket возвращает пополненную корзину ключа. Вызывается под l.Lock.
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	return b
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+}
+
+// prune удаляет корзины, которые успели наполниться: они не отличаются от новых.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type apiServer struct {
+	s        *transport
+	cfg      *Config
+	tokens   []string
+	limiter  *rateLimiter
+	failures *rateLimiter
+}
+
+// auth проверяет токен и ограничение частоты запросов.
+func (a *apiServer) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if a.failures.exhausted(client) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(1/authFailRate)))
+			http.Error(w, "too many failed attempts", http.StatusTooManyRequests)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		known := false
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				known = true
+			}
+		}
+		if !known {
+			a.failures.allow(client)
+			log.Debugf("API: unknown token from %v", client)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-fetch"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !a.limiter.allow(token) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// apiError - ошибка в параметрах запроса, отдаётся клиенту как 400.
+type apiError struct{ msg string }
+
+func (e apiError) Error() string { return e.msg }
+
+func (a *apiServer) handle(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return a.auth(func(w http.ResponseWriter, r *http.Request) {
+		result, err := fn(r)
+		if err != nil {
+			if _, ok := err.(apiError); ok {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Errorf("Error in API %v:%v", r.URL.Path, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// parseAPITime понимает то же, что -from и -to, а также RFC 3339 и unix-время от Grafana.
+func parseAPITime(value string, end bool) (time.Time, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n > 1e12 {
+			return time.Unix(0, n*int64(time.Millisecond)), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return parseTimeArg(value, end)
+}
+
+// apiPeriod читает from и to, по умолчанию - сегодня.
+func apiPeriod(r *http.Request) (p period, err error) {
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if from == "" {
+		from = "today"
+	}
+	if to == "" {
+		to = "today"
+	}
+	if p.from, err = parseAPITime(from, false); err != nil {
+		return p, apiError{err.Error()}
+	}
+	if p.to, err = parseAPITime(to, true); err != nil {
+		return p, apiError{err.Error()}
+	}
+	if !p.from.Before(p.to) {
+		return p, apiError{"from must be before to"}
+	}
+	return p, nil
+}
+
+func apiInt(r *http.Request, name string, def, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, apiError{fmt.Sprintf("bad %v %q", name, value)}
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	return n, nil
+}
+
+type trafficPoint struct {
+	Time  int64  `json:"time"`
+	Name  string `json:"name,omitempty"`
+	Bytes int64  `json:"bytes"`
+}
+
+// traffic - трафик по часам или дням, с by=user|ip|site - отдельно по каждому.
+func (a *apiServer) traffic(r *http.Request) (interface{}, error) {
+	p, err := apiPeriod(r)
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	proxy, err := apiInt(r, "proxy", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	opts := reportOptions{period: p, user: q.Get("user"), ip: q.Get("ip"), site: q.Get("site")}
+	// часы и дни по местному времени, как в отчётах и verify
+	bucket := hourSQL("t.date")
+	switch q.Get("bucket") {
+	case "", "hour":
+	case "day":
+		bucket = "unix_timestamp(from_unixtime(t.date,'%Y-%m-%d'))"
+	default:
+		return nil, apiError{"bucket must be 'hour' or 'day'"}
+	}
+	name := "''"
+	if by := q.Get("by"); by != "" {
+		if by == "mime" || by == "status" || reportColumns[by] == "" {
+			return nil, apiError{"by must be 'user', 'ip' or 'site'"}
+		}
+		name = reportColumns[by]
+	}
+	return a.s.trafficBuckets(r.Context(), &opts, proxy, bucket, name, a.cfg.api.maxRows)
+}
+
+func (s *transport) trafficBuckets(ctx context.Context, opts *reportOptions, numProxy int, bucket, name string, limit int) ([]trafficPoint, error) {
+	from, where, args := reportQuery(opts, numProxy)
+	rows, err := s.db.QueryContext(ctx, "select "+bucket+" as bucket, "+name+" as name, sum(t.sizeinbytes) from "+from+
+		" where "+where+" group by bucket, name order by bucket, name limit "+strconv.Itoa(limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	points := []trafficPoint{}
+	for rows.Next() {
+		var pt trafficPoint
+		if err := rows.Scan(&pt.Time, &pt.Name, &pt.Bytes); err != nil {
+			return nil, err
+		}
+		points = append(points, pt)
+	}
+	return points, rows.Err()
+}
+
+func (a *apiServer) top(r *http.Request) (interface{}, error) {
+	p, err := apiPeriod(r)
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	opts := reportOptions{period: p, by: q.Get("by"), user: q.Get("user"), ip: q.Get("ip"), site: q.Get("site")}
+	if opts.by == "" {
+		opts.by = "user"
+	}
+	if _, ok := reportColumns[opts.by]; !ok {
+		return nil, apiError{"by must be 'user', 'ip', 'site', 'mime' or 'status'"}
+	}
+	if opts.top, err = apiInt(r, "limit", 10, a.cfg.api.maxRows); err != nil {
+		return nil, err
+	}
+	if opts.top == 0 {
+		opts.top = a.cfg.api.maxRows
+	}
+	proxy, err := apiInt(r, "proxy", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	rows, total, err := a.s.topTraffic(r.Context(), &opts, proxy)
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		rows = []reportRow{}
+	}
+	return struct {
+		Total int64       `json:"total"`
+		Rows  []reportRow `json:"rows"`
+	}{total, rows}, nil
+}
+
+// requests - поиск по scsq_traffic. next - offset следующей страницы, 0 - страниц больше нет.
+func (a *apiServer) requests(r *http.Request) (interface{}, error) {
+	p, err := apiPeriod(r)
+	if err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	limit, err := apiInt(r, "limit", 100, a.cfg.api.maxRows)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		limit = a.cfg.api.maxRows
+	}
+	offset, err := apiInt(r, "offset", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := apiInt(r, "proxy", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	where := "t.date>=? and t.date<?"
+	args := []interface{}{p.from.Unix(), p.to.Unix()}
+	for _, f := range []struct{ param, cond string }{
+		{"user", "l.name=?"},
+		{"ip", "ip.name=?"},
+		{"status", "h.name like ?"},
+		{"method", "t.method=?"},
+		{"mime", "t.mime=?"},
+		{"site", "t.site like ?"},
+	} {
+		value := q.Get(f.param)
+		if value == "" {
+			continue
+		}
+		if strings.HasSuffix(f.cond, "like ?") {
+			value = "%" + value + "%"
+		}
+		where += " and " + f.cond
+		args = append(args, value)
+	}
+	if proxy > 0 {
+		where += " and t.numproxy=?"
+		args = append(args, proxy)
+	}
+	// на одну строку больше, чтобы узнать, есть ли следующая страница
+	args = append(args, limit+1, offset)
+	rows, err := a.s.db.QueryContext(r.Context(), `select t.date, coalesce(ip.name,''), coalesce(l.name,''), coalesce(h.name,''),
+		t.sizeinbytes, t.site, t.method, t.mime
+	from scsq_traffic t
+	left join scsq_ipaddress ip on t.ipaddress=ip.id
+	left join scsq_logins l on t.login=l.id
+	left join scsq_httpstatus h on t.httpstatus=h.id
+	where `+where+`
+	order by t.date, t.id limit ? offset ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := struct {
+		Rows []exportRow `json:"rows"`
+		Next int         `json:"next,omitempty"`
+	}{Rows: []exportRow{}}
+	for rows.Next() {
+		var e exportRow
+		if err := rows.Scan(&e.Date, &e.IPAddress, &e.Login, &e.HTTPStatus, &e.SizeInBytes, &e.Site, &e.Method, &e.Mime); err != nil {
+			return nil, err
+		}
+		if len(result.Rows) == limit {
+			result.Next = offset + limit
+			break
+		}
+		result.Rows = append(result.Rows, e)
+	}
+	return result, rows.Err()
+}
+
+type proxyInfo struct {
+	Proxy int `json:"proxy"`
+	// LastData - время последних данных в scsq_quicktraffic
+	LastData int64 `json:"last_data"`
+	// LastImport и LastStatus - из scsq_runs, если go-fetch его ведёт
+	LastImport int64  `json:"last_import,omitempty"`
+	LastStatus string `json:"last_status,omitempty"`
+}
+
+func (a *apiServer) proxies(r *http.Request) (interface{}, error) {
+	return a.s.proxies(r.Context())
+}
+
+func (s *transport) proxies(ctx context.Context) ([]proxyInfo, error) {
+	rows, err := s.db.QueryContext(ctx, "select numproxy, max(date) from scsq_quicktraffic group by numproxy order by numproxy")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []proxyInfo{}
+	index := map[int]int{}
+	for rows.Next() {
+		var p proxyInfo
+		if err := rows.Scan(&p.Proxy, &p.LastData); err != nil {
+			return nil, err
+		}
+		index[p.Proxy] = len(list)
+		list = append(list, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !s.tableExists("scsq_runs") {
+		return list, nil
+	}
+	runs, err := s.db.QueryContext(ctx, `select r.numproxy, r.dateend, r.status from scsq_runs r
+	join (select numproxy, max(id) as id from scsq_runs where command in ('import','follow') group by numproxy) last
+	on r.id=last.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer runs.Close()
+	for runs.Next() {
+		var p proxyInfo
+		if err := runs.Scan(&p.Proxy, &p.LastImport, &p.LastStatus); err != nil {
+			return nil, err
+		}
+		if i, ok := index[p.Proxy]; ok {
+			list[i].LastImport, list[i].LastStatus = p.LastImport, p.LastStatus
+		} else {
+			list = append(list, p)
+		}
+	}
+	return list, runs.Err()
+}
+
+func runAPI(ctx context.Context, cfg *Config) error {
+	tokens, err := readTokens(&cfg.api)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	a := &apiServer{s: store, cfg: cfg, tokens: tokens,
+		limiter:  newRateLimiter(cfg.api.rate, cfg.api.burst),
+		failures: newRateLimiter(authFailRate, authFailBurst)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/traffic", a.handle(a.traffic))
+	mux.HandleFunc("/api/v1/top", a.handle(a.top))
+	mux.HandleFunc("/api/v1/requests", a.handle(a.requests))
+	mux.HandleFunc("/api/v1/proxies", a.handle(a.proxies))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	var ln net.Listener
+	if cfg.api.addr == "systemd" {
+		ln, err = systemdListener("api")
+	} else if ln, err = net.Listen("tcp", cfg.api.addr); err != nil {
+		err = fmt.Errorf("Error listen(%v):%v", cfg.api.addr, err)
+	}
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Infof("Serving the API on %v", ln.Addr())
+	if err := sdNotify("READY=1\nSTATUS=Serving the API"); err != nil {
+		log.Warningf("Error sd_notify:%v", err)
+	}
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if !l.allow("a") {
+			t.Fatalf("request %v within burst is denied", i+1)
+		}
+	}
+	if l.allow("a") {
+		t.Error("request over burst is allowed")
+	}
+	if !l.allow("b") {
+		t.Error("another token shares the bucket")
+	}
+
+	// через две секунды набирается два запроса, но не больше burst
+	l.buckets["a"].last = l.buckets["a"].last.Add(-2 * time.Second)
+	for i := 0; i < 2; i++ {
+		if !l.allow("a") {
+			t.Fatalf("refilled request %v is denied", i+1)
+		}
+	}
+	if l.allow("a") {
+		t.Error("bucket is refilled over the rate")
+	}
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Hour)
+	allowed := 0
+	for l.allow("a") {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("%v requests after an hour, want burst 3", allowed)
+	}
+
+	unlimited := newRateLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow("a") {
+			t.Fatal("rate 0 must not limit")
+		}
+	}
+}
+
+func TestParseAPITime(t *testing.T) {
+	today := time.Now()
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		value string
+		end   bool
+		want  time.Time
+		err   bool
+	}{
+		{"1600000000", false, time.Unix(1600000000, 0), false},
+		{"1600000000123", false, time.Unix(1600000000, 123*int64(time.Millisecond)), false},
+		{"2026-10-19T10:00:00+03:00", false, time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), false},
+		{"2026-10-19", false, time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local), false},
+		{"2026-10-19", true, time.Date(2026, 10, 20, 0, 0, 0, 0, time.Local), false},
+		{"2026-10-19 10:30", true, time.Date(2026, 10, 19, 10, 30, 0, 0, time.Local), false},
+		{"today", false, today, false},
+		{"yesterday", true, today, false},
+		{"19.10.2026", false, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseAPITime(tt.value, tt.end)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if !tt.err && !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	for i := 0; i < maxBuckets; i++ {
+		l.allow(fmt.Sprint(i))
+	}
+	l.allow("busy")
+	for key, b := range l.buckets {
+		if key != "busy" {
+			b.last = b.last.Add(-time.Minute)
+		}
+	}
+	l.allow("new")
+	if len(l.buckets) != 2 {
+		t.Errorf("%v buckets after prune, want busy and new", len(l.buckets))
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	a := &apiServer{tokens: []string{"secret"}, limiter: newRateLimiter(0, 0),
+		failures: newRateLimiter(authFailRate, authFailBurst)}
+	h := a.auth(func(w http.ResponseWriter, r *http.Request) {})
+	get := func(addr, token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/proxies", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+	for i := 0; i < authFailBurst; i++ {
+		if code := get("192.0.2.1:1000", "guess"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %v: got %v, want 401", i+1, code)
+		}
+	}
+	// после исчерпания лимита с адреса не проходит даже верный токен
+	if code := get("192.0.2.1:1001", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("got %v, want 429", code)
+	}
+	if code := get("192.0.2.2:1000", "secret"); code != http.StatusOK {
+		t.Errorf("another address: got %v, want 200", code)
+	}
+	a.failures.buckets["192.0.2.1"].last = a.failures.buckets["192.0.2.1"].last.Add(-time.Duration(1/authFailRate) * time.Second)
+	if code := get("192.0.2.1:1002", "secret"); code != http.StatusOK {
+		t.Errorf("after the backoff: got %v, want 200", code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkpoint - позиция в файле лога, до которой данные гарантированно
+// записаны в БД и подтверждены потребителем потока.
+type checkpoint struct {
+	File   string    `json:"file"`
+	Offset int64     `json:"offset"`
+	Time   time.Time `json:"time"`
+	// Head - md5 первой строки файла. После ротации имя то же, а новый файл
+	// мог уже вырасти больше Offset, поэтому файл узнаётся по первой строке.
+	Head string `json:"head,omitempty"`
+}
+
+func readCheckpoint(filename string) (checkpoint, error) {
+	var cp checkpoint
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, nil
+		}
+		return cp, fmt.Errorf("Error read checkpoint(%v):%v", filename, err)
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("Error parse checkpoint(%v):%v", filename, err)
+	}
+	return cp, nil
+}
+
+// writeCheckpoint пишет во временный файл и переименовывает его,
+// чтобы при падении не остался наполовину записанный checkpoint.
+func writeCheckpoint(filename string, cp checkpoint) error {
+	cp.Time = time.Now()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Error write checkpoint(%v):%v", tmp, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("Error rename checkpoint(%v):%v", tmp, err)
+	}
+	return nil
+}
+
+// resumeOffset возвращает смещение, с которого нужно продолжить чтение файла.
+// Если файл другой, стал короче checkpoint'а или начинается с другой строки
+// (ротация) - читаем с начала.
+func resumeOffset(cp checkpoint, fileName string) int64 {
+	if cp.File != fileName || cp.Offset == 0 {
+		return 0
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || stat.Size() < cp.Offset {
+		return 0
+	}
+	// checkpoint'ы старых версий без Head проверяются только по размеру
+	if cp.Head != "" && cp.Head != fileHead(file) {
+		log.Warningf("File %v was rotated since the checkpoint, reading it from the start", fileName)
+		return 0
+	}
+	return cp.Offset
+}
+
+// fileHead возвращает md5 первой строки файла, "" - если она ещё не дописана.
+// ReadAt не сдвигает позицию чтения файла.
+func fileHead(file *os.File) string {
+	line, err := bufio.NewReader(io.NewSectionReader(file, 0, 1<<20)).ReadBytes('\n')
+	if err != nil {
+		return ""
+	}
+	sum := md5.Sum(line)
+	return hex.EncodeToString(sum[:])
+}
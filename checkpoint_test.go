@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeOffset(t *testing.T) {
+	dir := tempDir(t)
+	name := filepath.Join(dir, "access.log")
+	appendFile(t, name, "1600000000.1 a\n1600000000.2 b\n")
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := fileHead(file)
+	file.Close()
+	if head == "" {
+		t.Fatal("no head of a complete first line")
+	}
+
+	rotated := filepath.Join(dir, "rotated.log")
+	appendFile(t, rotated, "1600003600.1 c\n1600003600.2 d\n1600003600.3 e\n")
+	unterminated := filepath.Join(dir, "unterminated.log")
+	appendFile(t, unterminated, "1600000000.1 a")
+
+	tests := []struct {
+		name string
+		cp   checkpoint
+		file string
+		want int64
+	}{
+		{"same file", checkpoint{File: name, Offset: 15, Head: head}, name, 15},
+		{"no checkpoint", checkpoint{}, name, 0},
+		{"another name", checkpoint{File: rotated, Offset: 15, Head: head}, name, 0},
+		{"shorter", checkpoint{File: name, Offset: 100, Head: head}, name, 0},
+		// новый файл с тем же именем уже длиннее старого смещения
+		{"rotated and grown", checkpoint{File: rotated, Offset: 15, Head: head}, rotated, 0},
+		{"checkpoint without head", checkpoint{File: rotated, Offset: 15}, rotated, 15},
+		{"missing file", checkpoint{File: filepath.Join(dir, "missing"), Offset: 15, Head: head}, filepath.Join(dir, "missing"), 0},
+		{"unterminated first line", checkpoint{File: unterminated, Offset: 5, Head: head}, unterminated, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resumeOffset(tt.cp, tt.file); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	name := filepath.Join(tempDir(t), "checkpoint.json")
+	if cp, err := readCheckpoint(name); err != nil || cp.Offset != 0 {
+		t.Fatalf("missing checkpoint: %+v, %v", cp, err)
+	}
+	want := checkpoint{File: "/var/log/squid/access.log", Offset: 42, Head: "abc"}
+	if err := writeCheckpoint(name, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readCheckpoint(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.File != want.File || got.Offset != want.Offset || got.Head != want.Head || got.Time.IsZero() {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// command - подкоманда go-fetch. Общие параметры (БД, логи, PID, номер прокси)
+// есть у всех команд, flags добавляет параметры конкретной команды.
+type command struct {
+	name  string
+	short string
+	flags func(fs *flag.FlagSet, cfg *Config)
+	run   func(ctx context.Context, cfg *Config) error
+}
+
+var commands []*command
+
+// Список заполняется в init: команды сами разбирают настройки (например, при
+// перечитывании по SIGHUP), и прямая инициализация дала бы цикл.
+func init() {
+	commands = []*command{
+		{
+			name:  "import",
+			short: "import new lines from the squid log and exit (default)",
+			flags: importFlags,
+			run:   runImport,
+		},
+		{
+			name:  "follow",
+			short: "import the squid log and keep waiting for new lines",
+			flags: func(fs *flag.FlagSet, cfg *Config) {
+				importFlags(fs, cfg)
+				fs.DurationVar(&cfg.pollInterval, "poll", 5*time.Second, "How often to check the log for new lines")
+			},
+			run: func(ctx context.Context, cfg *Config) error {
+				cfg.follow = true
+				return runImport(ctx, cfg)
+			},
+		},
+		{
+			name:  "replay",
+			short: "reprocess lines from quarantine",
+			flags: quarantineFlags,
+			run:   runReplay,
+		},
+		{
+			name:  "migrate",
+			short: "create tables used by go-fetch",
+			run:   runMigrate,
+		},
+		{
+			name:  "purge",
+			short: "delete traffic older than the given date or number of days",
+			flags: purgeFlags,
+			run:   runPurge,
+		},
+		{
+			name:  "rebuild",
+			short: "recompute scsq_quicktraffic from scsq_traffic for a period",
+			flags: rebuildFlags,
+			run:   runRebuild,
+		},
+		{
+			name:  "verify",
+			short: "compare per-hour lines and bytes in the logs with the DB",
+			flags: verifyFlags,
+			run:   runVerify,
+		},
+		{
+			name:  "daemon",
+			short: "run import, rebuild, purge and verify on an internal schedule",
+			flags: daemonFlags,
+			run:   runDaemon,
+		},
+		{
+			name:  "helper",
+			short: "answer Squid external_acl_type requests by -quotas or daily and monthly quotas",
+			flags: helperFlags,
+			run:   runHelper,
+		},
+		{
+			name:  "quota",
+			short: "compute quota usage, record breaches and write blocklists for Squid",
+			flags: quotaFlags,
+			run:   runQuota,
+		},
+		{
+			name:  "status",
+			short: "show recent runs and flag failed or empty ones",
+			flags: statusFlags,
+			run:   runStatusCmd,
+		},
+		{
+			name:  "report",
+			short: "show top users, addresses, sites, MIME types or statuses for a period",
+			flags: reportFlags,
+			run:   runReport,
+		},
+		{
+			name:  "mail",
+			short: "send HTML traffic reports to the recipients by SMTP",
+			flags: func(fs *flag.FlagSet, cfg *Config) {
+				periodFlags(fs, &cfg.mail.period, "yesterday", "yesterday")
+				mailFlags(fs, cfg)
+				fs.StringVar(&cfg.quota.file, "quotas", "", "File with quota definitions, groups and departments are taken from it")
+			},
+			run: runMail,
+		},
+		{
+			name:  "api",
+			short: "serve a read-only HTTP API over the imported traffic",
+			flags: apiFlags,
+			run:   runAPI,
+		},
+		{
+			name:  "export",
+			short: "export raw traffic for a period as CSV or JSON",
+			flags: exportFlags,
+			run:   runExport,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// globalFlags - параметры, общие для всех команд.
+func globalFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.typedb, "typedb", "mysql", `Type of DB:
+		'mysql' - MySQL,
+		'postgres' - PostgreSQL`)
+	fs.StringVar(&cfg.userDB, "u", "root", "User of DB")
+	fs.StringVar(&cfg.passDB, "p", "", "Password of DB")
+	fs.StringVar(&cfg.hostDB, "h", "localhost", "host of DB")
+	fs.StringVar(&cfg.nameDB, "n", "squidreport2", "name of DB")
+	fs.IntVar(&cfg.NumPrnoxy, "np", 1, "Number of proxy")
+	fs.IntVar(&cfg.NumPrnoxy, "proxy", 1, "Deprecated, use -np")
+	fs.StringVar(&cfg.LogLevel, "loglevel", "info", "Level log:")
+	fs.StringVar(&cfg.PIDFileName, "pid", "/run/go-fetch.pid", "Path to PID file, the number of proxy other than 1 is added to the name: go-fetch-2.pid")
+	fs.IntVar(&cfg.dbRetries, "db-retries", 5, "How many times to retry a DB query after a transient error")
+	fs.DurationVar(&cfg.dbRetryDelay, "db-retry-delay", time.Second, "Initial delay between retries, doubled after each attempt")
+	fs.String("config", "", "Config file (TOML, or YAML for *.yaml/*.yml) with the same keys as the flags")
+	fs.String("password-file", "", "File with the password of DB, used only if the password is not set by -p, GO_FETCH_P/GO_FETCH_PASSWORD, the config file or config.php")
+	fs.String("screensquid-config", "", "Take DB settings from Screen Squid's config.php")
+	fs.String("screensquid-index", "0", "Index of the server in Screen Squid's config.php")
+	logFlags(fs, cfg)
+}
+
+func importFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.fileLog, "log", "/var/log/squid/access.log", "Squid log file")
+	fs.IntVar(&cfg.numLines, "nl", 1000, "Number of lines")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "Read and parse the log without writing to DB, print a summary")
+	fs.StringVar(&cfg.checkpointFile, "checkpoint", "", "File to store the position in the log up to which data is committed")
+	fs.StringVar(&cfg.streamType, "stream", "none", `Publish parsed records to:
+		'none' - do not publish,
+		'nats' - NATS subject,
+		'kafka' - Kafka topic via Confluent REST Proxy (API v2), the native Kafka protocol is not supported`)
+	fs.StringVar(&cfg.streamAddr, "stream-addr", "localhost:4222", "Address of NATS server or URL of Confluent Kafka REST Proxy, e.g. http://localhost:8082")
+	fs.StringVar(&cfg.streamTopic, "stream-topic", "go-fetch", "NATS subject or Kafka topic")
+	fs.StringVar(&cfg.streamKey, "stream-key", "ip", "Key of published record: 'ip' or 'login'")
+	fs.StringVar(&cfg.streamFormat, "stream-format", "json", "Format of published record: 'json' or 'protobuf'")
+	fs.IntVar(&cfg.streamBuffer, "stream-buffer", 100000, "Records kept for the stream while the broker is unreachable, the rest are dropped and counted in go_fetch_stream_dropped_total, 0 - no limit")
+	fs.StringVar(&cfg.dedupType, "dedup", "none", `Skip lines that were already imported:
+		'none' - do not check,
+		'index' - remember line hashes in the table scsq_dedup,
+		'bloom' - remember line hashes in memory (bloom filter, only within this run)`)
+	fs.IntVar(&cfg.dedupSize, "dedup-size", 10000000, "Expected number of lines for the bloom filter")
+	quarantineFlags(fs, cfg)
+	metricsFlags(fs, cfg)
+	progressFlags(fs, cfg)
+}
+
+func quarantineFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.quarantineType, "quarantine", "none", `Where to put rejected lines:
+		'none' - only log them,
+		'file' - to the file set by -quarantine-file,
+		'table' - to the table scsq_quarantine`)
+	fs.StringVar(&cfg.quarantineFile, "quarantine-file", "/var/log/squid/go-fetch.quarantine", "File for rejected lines")
+}
+
+// newFlagSet собирает параметры команды вместе с общими.
+func newFlagSet(cmd *command, cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("go-fetch "+cmd.name, flag.ExitOnError)
+	globalFlags(fs, cfg)
+	if cmd.flags != nil {
+		cmd.flags(fs, cfg)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: go-fetch %v [options]\n\n%v.\n\nOptions:\n", cmd.name, cmd.short)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// isKnownOption проверяет, что параметр есть хотя бы у одной команды.
+// Файл настроек общий, и в нём могут быть параметры других команд.
+func isKnownOption(name string) bool {
+	var cfg Config
+	for _, cmd := range commands {
+		if newFlagSet(cmd, &cfg).Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: go-fetch [command] [options]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10v %v\n", name, findCommand(name).short)
+	}
+	// -h - это адрес БД, поэтому подсказка только про help и -help
+	fmt.Fprintf(os.Stderr, "\nRun 'go-fetch help <command>' or 'go-fetch <command> -help' for the command options.\n")
+	fmt.Fprintf(os.Stderr, "Without a command go-fetch runs 'import'.\n")
+}
+
+// parseCommandLine определяет команду и разбирает её параметры.
+// Для совместимости со старым запуском из cron без команды выполняется import.
+func parseCommandLine(args []string, cfg *Config) (*command, error) {
+	name := "import"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		if len(args) > 0 {
+			if cmd := findCommand(args[0]); cmd != nil {
+				newFlagSet(cmd, cfg).Usage()
+				os.Exit(0)
+			}
+		}
+		usage()
+		os.Exit(0)
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		usage()
+		return nil, fmt.Errorf("Error. Unknown command %q", name)
+	}
+	fs := newFlagSet(cmd, cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("Error. Unexpected arguments: %v", strings.Join(fs.Args(), " "))
+	}
+	if err := loadConfig(fs); err != nil {
+		return nil, err
+	}
+	// -nl есть не у всех команд, поэтому он проверяется здесь, а не в setupAndValidate
+	if fs.Lookup("nl") != nil && cfg.numLines <= 0 {
+		return nil, fmt.Errorf("Error. nl must be greater than 0.")
+	}
+	return cmd, nil
+}
+
+// setupAndValidate настраивает уровень логов и проверяет общие параметры.
+func setupAndValidate(cfg *Config) error {
+	lvl, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		log.Errorf("Error in determining the level of logs (%v). Installed by default = Info", cfg.LogLevel)
+		lvl, _ = log.ParseLevel("info")
+	}
+	log.SetLevel(lvl)
+
+	if cfg.typedb != "mysql" && cfg.typedb != "postgres" {
+		return fmt.Errorf("Error. typedb must be 'mysql' or 'postgres'.")
+	}
+	if cfg.userDB == "" {
+		return fmt.Errorf("Error. Username must be specified.")
+	}
+	if cfg.streamKey != "" && cfg.streamKey != "ip" && cfg.streamKey != "login" {
+		return fmt.Errorf("Error. stream-key must be 'ip' or 'login'.")
+	}
+	if cfg.streamFormat != "" && cfg.streamFormat != "json" && cfg.streamFormat != "protobuf" {
+		return fmt.Errorf("Error. stream-format must be 'json' or 'protobuf'.")
+	}
+
+	// dsn := "user:password@(host_bd)/dbname"
+	// db, err := sql.Open("mysql", dsn)
+	cfg.SQLAddr = fmt.Sprintf("%v:%v@(%v)/%v", cfg.userDB, cfg.passDB, cfg.hostDB, cfg.nameDB)
+	return nil
+}
+
+// openStore подключается к БД. Команды, изменяющие данные, передают lock,
+// чтобы не работать параллельно с другим процессом того же прокси.
+// Отмена ctx прерывает ожидание перед повтором запроса к БД.
+func openStore(ctx context.Context, cfg *Config, lock bool) (*transport, error) {
+	var l *instanceLock
+	if lock {
+		var err error
+		if l, err = acquireLock(lockFileName(cfg.PIDFileName, cfg.NumPrnoxy)); err != nil {
+			return nil, err
+		}
+	}
+
+	retry := retryPolicy{
+		ctx:      ctx,
+		attempts: cfg.dbRetries,
+		delay:    cfg.dbRetryDelay,
+		maxDelay: time.Minute,
+	}
+	db, err := newDB(cfg.typedb, cfg.SQLAddr, retry)
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+
+	store := newStore(db)
+	store.retry = retry
+	store.lock = l
+	return store, nil
+}
+
+// Close закрывает соединения и снимает блокировку, если она наша.
+func (s *transport) Close() {
+	if s.pub != nil {
+		s.pub.Close()
+	}
+	if s.quar != nil {
+		s.quar.Close()
+	}
+	s.db.Close()
+	s.lock.release()
+}
+
+// period - интервал времени для команд обслуживания и отчётов.
+// Дата без времени в -to означает конец этого дня.
+type period struct {
+	fromStr string
+	toStr   string
+	from    time.Time
+	to      time.Time
+}
+
+func periodFlags(fs *flag.FlagSet, p *period, defFrom, defTo string) {
+	fs.StringVar(&p.fromStr, "from", defFrom, "Start of the period: YYYY-MM-DD[ HH:MM], 'today' or 'yesterday'")
+	fs.StringVar(&p.toStr, "to", defTo, "End of the period (inclusive for a date): YYYY-MM-DD[ HH:MM], 'today' or 'yesterday'")
+}
+
+func (p *period) parse() error {
+	var err error
+	if p.from, err = parseTimeArg(p.fromStr, false); err != nil {
+		return err
+	}
+	if p.to, err = parseTimeArg(p.toStr, true); err != nil {
+		return err
+	}
+	if !p.from.Before(p.to) {
+		return fmt.Errorf("Error. Period is empty: %v - %v", p.fromStr, p.toStr)
+	}
+	return nil
+}
+
+func parseTimeArg(value string, end bool) (time.Time, error) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	var t time.Time
+	switch value {
+	case "now":
+		return now, nil
+	case "today":
+		t = today
+	case "yesterday":
+		t = today.AddDate(0, 0, -1)
+	default:
+		var err error
+		if t, err = time.ParseInLocation("2006-01-02 15:04", value, time.Local); err == nil {
+			return t, nil
+		}
+		if t, err = time.ParseInLocation("2006-01-02", value, time.Local); err != nil {
+			return t, fmt.Errorf("Error. Bad date %q, expected YYYY-MM-DD[ HH:MM]", value)
+		}
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
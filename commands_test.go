@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestParseCommandLineLines(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"import", "-nl", "10"}, true},
+		{[]string{"import", "-nl", "0"}, false},
+		{[]string{"-nl", "-1"}, false},
+		{[]string{"verify", "-nl", "0"}, false},
+		// у report нет -nl, и нулевое значение поля не ошибка
+		{[]string{"report"}, true},
+	}
+	for _, tt := range tests {
+		var cfg Config
+		_, err := parseCommandLine(tt.args, &cfg)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: got error %v, want ok %v", tt.args, err, tt.ok)
+		}
+	}
+}
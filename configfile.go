@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Настройки собираются из нескольких источников. Каждый следующий
+// перекрывает предыдущий:
+//
+//	значения по умолчанию < -password-file < config.php Screen Squid
+//	< файл настроек < переменные окружения GO_FETCH_* < флаги командной строки
+//
+// Пароль из -password-file используется, только если ни один другой
+// источник пароль не задал, даже пустой.
+//
+// В файле и в окружении используются те же имена, что и у флагов,
+// а для коротких флагов БД есть понятные синонимы (user, password, host, name).
+var configAliases = map[string]string{
+	"user":     "u",
+	"password": "p",
+	"host":     "h",
+	"name":     "n",
+	"dbname":   "n",
+	"numproxy": "np",
+	"proxy":    "np",
+	"lines":    "nl",
+}
+
+// deprecatedOptions - устаревшие имена параметров и их замена.
+var deprecatedOptions = map[string]string{
+	"proxy": "np",
+}
+
+const envPrefix = "GO_FETCH_"
+
+// loadConfig применяет к уже разобранным флагам значения из файлов и окружения,
+// не трогая флаги, явно заданные в командной строке.
+func loadConfig(fs *flag.FlagSet) error {
+	// explicit - флаги из командной строки, source - откуда взят параметр
+	explicit := make(map[string]bool)
+	source := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+		source[f.Name] = "-" + f.Name
+		if name, ok := configAliases[f.Name]; ok {
+			explicit[name] = true
+			source[name] = "-" + f.Name
+		}
+		if name, ok := deprecatedOptions[f.Name]; ok {
+			log.Warningf("Option -%v is deprecated, use -%v", f.Name, name)
+		}
+	})
+	set := func(from, key, value string) error {
+		if name, ok := deprecatedOptions[strings.ToLower(key)]; ok {
+			log.Warningf("Option %q in %v is deprecated, use %q", key, from, name)
+		}
+		name := key
+		if alias, ok := configAliases[key]; ok {
+			name = alias
+		}
+		if fs.Lookup(name) == nil {
+			if isKnownOption(name) {
+				// параметр другой команды
+				return nil
+			}
+			return fmt.Errorf("Error in %v: unknown option %q", from, key)
+		}
+		if explicit[name] {
+			return nil
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("Error in %v: option %q:%v", from, key, err)
+		}
+		source[name] = from
+		return nil
+	}
+
+	configFile := fs.Lookup("config").Value.String()
+	if !explicit["config"] {
+		if env, ok := os.LookupEnv(envPrefix + "CONFIG"); ok {
+			configFile = env
+		}
+	}
+	phpFile := fs.Lookup("screensquid-config").Value.String()
+	if !explicit["screensquid-config"] {
+		if env, ok := os.LookupEnv(envPrefix + "SCREENSQUID_CONFIG"); ok {
+			phpFile = env
+		}
+	}
+
+	if phpFile != "" {
+		values, err := readScreenSquidConfig(phpFile, fs.Lookup("screensquid-index").Value.String())
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			if err := set(phpFile, key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if configFile != "" {
+		values, err := readConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			if err := set(configFile, key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	var errEnv error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(env); ok && errEnv == nil {
+			errEnv = set(env, f.Name, value)
+		}
+	})
+	for alias, name := range configAliases {
+		if value, ok := os.LookupEnv(envPrefix + strings.ToUpper(alias)); ok && errEnv == nil {
+			errEnv = set(envPrefix+strings.ToUpper(alias), name, value)
+		}
+	}
+	if errEnv != nil {
+		return errEnv
+	}
+
+	// Пароль из файла нужен, чтобы не светить его в ps и crontab.
+	// Заданный любым другим способом пароль важнее.
+	passwordFile := fs.Lookup("password-file").Value.String()
+	if passwordFile != "" && source["p"] != "" {
+		log.Warningf("Option password-file is ignored, the password is set by %v", source["p"])
+	} else if passwordFile != "" {
+		data, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return fmt.Errorf("Error read password file(%v):%v", passwordFile, err)
+		}
+		if err := fs.Set("p", strings.TrimSpace(string(data))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readConfigFile читает плоский файл настроек. Файлы .yaml/.yml разбираются
+// как YAML (`key: value`), остальные как TOML (`key = value`).
+// Вложенные секции не поддерживаются.
+func readConfigFile(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error open config file(%v):%v", filename, err)
+	}
+	defer file.Close()
+
+	sep := "="
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".yaml" || ext == ".yml" {
+		sep = ":"
+	}
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line == "---" {
+			continue
+		}
+		if line[0] == '[' {
+			return nil, fmt.Errorf("Error in config file(%v) line %v: sections are not supported", filename, num)
+		}
+		i := strings.Index(line, sep)
+		if i < 0 {
+			return nil, fmt.Errorf("Error in config file(%v) line %v: expected 'key %v value'", filename, num, sep)
+		}
+		key := strings.TrimSpace(line[:i])
+		value, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("Error in config file(%v) line %v:%v", filename, num, err)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// parseConfigValue снимает кавычки со строки или отрезает комментарий у простого значения.
+func parseConfigValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	switch value[0] {
+	case '"':
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %v", value)
+		}
+		return strconv.Unquote(value[:end+1])
+	case '\'':
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %v", value)
+		}
+		return value[1:end], nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+var phpAssignRe = regexp.MustCompile(`\$(address|user|pass|db|dbtype)\[(\d+)\]\s*=\s*("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|\d+)\s*;`)
+
+// readScreenSquidConfig достаёт параметры подключения к БД из config.php
+// Screen Squid. В нём может быть описано несколько серверов, index выбирает нужный.
+func readScreenSquidConfig(filename, index string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error read Screen Squid config(%v):%v", filename, err)
+	}
+	values := make(map[string]string)
+	for _, m := range phpAssignRe.FindAllStringSubmatch(string(data), -1) {
+		if m[2] != index {
+			continue
+		}
+		value := m[3]
+		if value[0] == '"' || value[0] == '\'' {
+			value = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\'`, `'`).Replace(value[1 : len(value)-1])
+		}
+		switch m[1] {
+		case "address":
+			values["host"] = value
+		case "user":
+			values["user"] = value
+		case "pass":
+			values["password"] = value
+		case "db":
+			values["name"] = value
+		case "dbtype":
+			if value == "1" {
+				values["typedb"] = "postgres"
+			} else {
+				values["typedb"] = "mysql"
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("Error. No DB settings with index %v found in Screen Squid config(%v)", index, filename)
+	}
+	return values, nil
+}
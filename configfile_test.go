@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	name = filepath.Join(tempDir(t), name)
+	if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		want map[string]string
+		err  string
+	}{
+		{
+			name: "toml",
+			file: "go-fetch.toml",
+			data: "# DB\nuser = \"squid\"\npassword = 'p#ss'\nnp = 2 # proxy\n\nlog = \"/var/log/squid/access.log\"\n",
+			want: map[string]string{"user": "squid", "password": "p#ss", "np": "2", "log": "/var/log/squid/access.log"},
+		},
+		{
+			name: "yaml",
+			file: "go-fetch.yaml",
+			data: "---\nuser: squid\nhost: \"db:3306\"\nempty:\n",
+			want: map[string]string{"user": "squid", "host": "db:3306", "empty": ""},
+		},
+		{
+			name: "escaped quote",
+			file: "go-fetch.toml",
+			data: `password = "a\"b"`,
+			want: map[string]string{"password": `a"b`},
+		},
+		{name: "section", file: "go-fetch.toml", data: "[db]\nuser = squid\n", err: "line 1: sections are not supported"},
+		{name: "no separator", file: "go-fetch.yml", data: "user = squid\n", err: "line 1: expected 'key : value'"},
+		{name: "unterminated", file: "go-fetch.toml", data: "\nuser = \"squid\n", err: "line 2:unterminated string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readConfigFile(writeFile(t, tt.file, tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadScreenSquidConfig(t *testing.T) {
+	const php = `<?php
+$address[0]="localhost";
+$user[0]="root";
+$pass[0]='it\'s';
+$db[0]="squid";
+$dbtype[0]=0;
+
+$address[1] = "pg.local";
+$user[1] = "scsq";
+$pass[1] = "p\"w";
+$db[1] = "scsq";
+$dbtype[1] = 1;
+?>`
+	file := writeFile(t, "config.php", php)
+	tests := []struct {
+		index string
+		want  map[string]string
+	}{
+		{"0", map[string]string{"host": "localhost", "user": "root", "password": "it's", "name": "squid", "typedb": "mysql"}},
+		{"1", map[string]string{"host": "pg.local", "user": "scsq", "password": `p"w`, "name": "scsq", "typedb": "postgres"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.index, func(t *testing.T) {
+			got, err := readScreenSquidConfig(file, tt.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readScreenSquidConfig(file, "2"); err == nil {
+		t.Error("want an error for a missing index")
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	passwordFile := writeFile(t, "password", "from-password-file\n")
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		args   []string
+		want   string
+	}{
+		{name: "password-file", want: "from-password-file"},
+		{name: "config file", config: "password = from-config\n", want: "from-config"},
+		{name: "empty in config file", config: "password = ''\n", want: ""},
+		{name: "env", config: "password = from-config\n", env: map[string]string{"GO_FETCH_PASSWORD": "from-env"}, want: "from-env"},
+		{name: "env short name", env: map[string]string{"GO_FETCH_P": "from-env"}, want: "from-env"},
+		{name: "flag", config: "password = from-config\n", env: map[string]string{"GO_FETCH_PASSWORD": "from-env"}, args: []string{"-p", "from-flag"}, want: "from-flag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				setenv(t, k, v)
+			}
+			args := append([]string{"-password-file", passwordFile}, tt.args...)
+			if tt.config != "" {
+				args = append(args, "-config", writeFile(t, "go-fetch.toml", tt.config))
+			}
+			var cfg Config
+			fs := newFlagSet(findCommand("import"), &cfg)
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfig(fs); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.passDB != tt.want {
+				t.Errorf("got password %q, want %q", cfg.passDB, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDeprecatedProxy(t *testing.T) {
+	for _, args := range [][]string{
+		{"-proxy", "3"},
+		{"-config", writeFile(t, "go-fetch.toml", "proxy = 3\n")},
+	} {
+		var cfg Config
+		fs := newFlagSet(findCommand("import"), &cfg)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(fs); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.NumPrnoxy != 3 {
+			t.Errorf("%v: got proxy %v, want 3", args, cfg.NumPrnoxy)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Управляющие сигналы для работы в режиме демона:
+//
+//	SIGHUP  - перечитать настройки: в follow не теряя накопленный пакет,
+//	          в daemon - расписание и настройки заданий; разовый импорт его игнорирует
+//	SIGUSR1 - переоткрыть собственный лог go-fetch после ротации
+//	SIGUSR2 - вывести в лог текущую статистику
+//
+// В Windows SIGUSR1 и SIGUSR2 нет, см. control_windows.go.
+
+// reloadRequests передаёт SIGHUP в цикл импорта, где настройки можно
+// заменить между строками, не трогая пакет, который ещё не записан,
+// или в планировщик daemon между заданиями.
+var reloadRequests = make(chan struct{}, 1)
+
+// reopenLog переоткрывает файл лога go-fetch, его задаёт setupLogging.
+// Если лог пишется в stderr, переоткрывать нечего.
+var reopenLog = func() error { return nil }
+
+var controlSignalsHandled bool
+
+// handleControlSignals ставит обработчики сигналов. reload - перечитывать настройки
+// по SIGHUP, без него (разовый импорт) SIGHUP игнорируется, чтобы не убить импорт
+// на середине.
+func handleControlSignals(reload bool) {
+	// в режиме daemon импорт запускается много раз, обработчик нужен один
+	if controlSignalsHandled {
+		return
+	}
+	controlSignalsHandled = true
+	var sigs []os.Signal
+	for _, sig := range []os.Signal{reopenLogSignal, statsSignal} {
+		if sig != nil {
+			sigs = append(sigs, sig)
+		}
+	}
+	if reload {
+		sigs = append(sigs, syscall.SIGHUP)
+	} else {
+		signal.Ignore(syscall.SIGHUP)
+	}
+	if len(sigs) == 0 {
+		// Notify без сигналов перехватил бы все
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		for sig := range c {
+			switch sig {
+			case syscall.SIGHUP:
+				log.Infof("Got %v, reloading config", sig)
+				select {
+				case reloadRequests <- struct{}{}:
+				default:
+					// перечитывание уже запрошено
+				}
+			case reopenLogSignal:
+				if err := reopenLog(); err != nil {
+					log.Errorf("Error reopen log:%v", err)
+				} else {
+					log.Infof("Got %v, log reopened", sig)
+				}
+			case statsSignal:
+				logStats()
+			}
+		}
+	}()
+}
+
+// logStats выводит в лог состояние импорта, то же, что отдаёт /status.
+func logStats() {
+	st := metrics.status()
+	log.Infof("Stats: file %v offset %v (committed %v, lag %v bytes), lines read/added/rejected/duplicate %v/%v/%v/%v, %.1f lines/sec, last batch %v",
+		st.File, st.Offset, st.CommittedOff, st.LagBytes,
+		st.LinesRead, st.LinesAdded, st.LinesRejected, st.LinesDuplicate, st.LinesPerSec,
+		st.LastBatch.Format(time.RFC3339))
+	if st.LastError != "" {
+		log.Infof("Stats: last error at %v:%v", st.LastErrorTime.Format(time.RFC3339), st.LastError)
+	}
+}
+
+// reloadConfig заново собирает настройки из командной строки, файлов и окружения
+// и применяет те, что можно менять на ходу: loglevel, nl, poll, metrics-file,
+// db-retries и db-retry-delay. Для остальных нужен перезапуск. Списков прокси,
+// правил нормализации и категорий сайтов в go-fetch нет, перечитывать их нечего.
+func (s *transport) reloadConfig(cfg *Config) {
+	var fresh Config
+	if _, err := parseCommandLine(os.Args[1:], &fresh); err != nil {
+		log.Errorf("Error reload config, keeping the current one:%v", err)
+		return
+	}
+	if err := setupAndValidate(&fresh); err != nil {
+		log.Errorf("Error reload config, keeping the current one:%v", err)
+		return
+	}
+
+	restart := []struct {
+		name    string
+		changed bool
+	}{
+		{"DB", fresh.SQLAddr != cfg.SQLAddr || fresh.typedb != cfg.typedb},
+		{"proxy", fresh.NumPrnoxy != cfg.NumPrnoxy},
+		{"log", fresh.fileLog != cfg.fileLog},
+		{"pid", fresh.PIDFileName != cfg.PIDFileName},
+		{"checkpoint", fresh.checkpointFile != cfg.checkpointFile},
+		{"stream", fresh.streamType != cfg.streamType || fresh.streamAddr != cfg.streamAddr ||
+			fresh.streamTopic != cfg.streamTopic || fresh.streamKey != cfg.streamKey || fresh.streamFormat != cfg.streamFormat},
+		{"dedup", fresh.dedupType != cfg.dedupType},
+		{"quarantine", fresh.quarantineType != cfg.quarantineType || fresh.quarantineFile != cfg.quarantineFile},
+		{"http-addr", fresh.httpAddr != cfg.httpAddr || fresh.readyMaxLag != cfg.readyMaxLag},
+	}
+	for _, opt := range restart {
+		if opt.changed {
+			log.Warningf("Option %v has changed, it will take effect after restart", opt.name)
+		}
+	}
+
+	cfg.LogLevel = fresh.LogLevel
+	cfg.numLines = fresh.numLines
+	cfg.pollInterval = fresh.pollInterval
+	cfg.metricsFile = fresh.metricsFile
+	cfg.dbRetries, cfg.dbRetryDelay = fresh.dbRetries, fresh.dbRetryDelay
+	s.retry.attempts, s.retry.delay = fresh.dbRetries, fresh.dbRetryDelay
+	log.Infof("Config reloaded: loglevel %v, nl %v, poll %v, db-retries %v, db-retry-delay %v",
+		cfg.LogLevel, cfg.numLines, cfg.pollInterval, cfg.dbRetries, cfg.dbRetryDelay)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	reopenLogSignal os.Signal = syscall.SIGUSR1
+	statsSignal     os.Signal = syscall.SIGUSR2
+)
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// В Windows нет SIGUSR1 и SIGUSR2: лог переоткрывается только при ротации
+// по -log-max-size и -log-max-age, статистика доступна на /status.
+var (
+	reopenLogSignal os.Signal
+	statsSignal     os.Signal
+)
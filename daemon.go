@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// daemon заменяет запуск из cron: задания выполняются по очереди одним
+// процессом, поэтому не пересекаются между собой, а от параллельного запуска
+// из cron защищает блокировка прокси, которую берёт каждая команда.
+
+type daemonOptions struct {
+	importEvery  time.Duration
+	rebuildEvery time.Duration
+	purgeEvery   time.Duration
+	verifyEvery  time.Duration
+	quotaEvery   time.Duration
+	mailEvery    time.Duration
+	// привязка запусков ко времени суток, пусто - от старта демона
+	importAt     string
+	rebuildAt    string
+	purgeAt      string
+	verifyAt     string
+	quotaAt      string
+	mailAt       string
+	verifyDays   int
+	verifyRepair bool
+	jitter       time.Duration
+	stateFile    string
+}
+
+func daemonFlags(fs *flag.FlagSet, cfg *Config) {
+	importFlags(fs, cfg)
+	purgeFlags(fs, cfg)
+	quotaFlags(fs, cfg)
+	mailFlags(fs, cfg)
+	opts := &cfg.daemon
+	fs.DurationVar(&opts.importEvery, "import-every", 5*time.Minute, "How often to import the squid log, 0 - never")
+	fs.DurationVar(&opts.rebuildEvery, "rebuild-every", time.Hour, "How often to rebuild today's scsq_quicktraffic, 0 - never")
+	fs.DurationVar(&opts.purgeEvery, "purge-every", 24*time.Hour, "How often to purge traffic older than -days, 0 - never")
+	fs.DurationVar(&opts.verifyEvery, "verify-every", 7*24*time.Hour, "How often to verify the last -verify-days against the logs, 0 - never")
+	fs.DurationVar(&opts.quotaEvery, "quota-every", 5*time.Minute, "How often to check -quotas and update the blocklists, 0 - never")
+	fs.DurationVar(&opts.mailEvery, "mail-every", 24*time.Hour, "How often to mail reports for the previous day to -mail-to and -mail-recipients, 0 - never")
+	// HH:MM или "sun HH:MM": от этого времени отсчитываются запуски по -*-every
+	fs.StringVar(&opts.importAt, "import-at", "", "Time of day the import runs are counted from, HH:MM, empty - from the daemon start")
+	fs.StringVar(&opts.rebuildAt, "rebuild-at", "", "Time of day the rebuild runs are counted from, e.g. 00:05 - five minutes past every hour, empty - from the daemon start")
+	fs.StringVar(&opts.purgeAt, "purge-at", "03:00", "Time of day to purge at, HH:MM, empty - from the daemon start")
+	fs.StringVar(&opts.verifyAt, "verify-at", "sun 04:00", "Day and time to verify at, 'sun HH:MM' or HH:MM, empty - from the daemon start")
+	fs.StringVar(&opts.quotaAt, "quota-at", "", "Time of day the quota checks are counted from, HH:MM, empty - from the daemon start")
+	fs.StringVar(&opts.mailAt, "mail-at", "07:00", "Time of day to mail reports at, HH:MM, empty - from the daemon start")
+	fs.IntVar(&opts.verifyDays, "verify-days", 7, "Number of days checked by the verify job")
+	fs.BoolVar(&opts.verifyRepair, "verify-repair", false, "Re-import hours that the verify job finds broken")
+	fs.DurationVar(&opts.jitter, "jitter", 30*time.Second, "Random delay added to every scheduled run")
+	fs.StringVar(&opts.stateFile, "schedule-state", "", "File to keep the last runs in, to catch up missed runs after a restart")
+}
+
+// job - задание расписания. Экспортируемые поля отдаются в /jobs и сохраняются в -schedule-state.
+// LastRun - ID последнего запуска, им помечены все сообщения задания в логе.
+type job struct {
+	Name       string        `json:"name"`
+	Every      time.Duration `json:"every"`
+	At         string        `json:"at,omitempty"`
+	Next       time.Time     `json:"next"`
+	LastStart  time.Time     `json:"last_start,omitempty"`
+	LastEnd    time.Time     `json:"last_end,omitempty"`
+	LastResult string        `json:"last_result,omitempty"`
+	LastRun    string        `json:"last_run,omitempty"`
+	Running    bool          `json:"running"`
+
+	at  *jobAt
+	run func(ctx context.Context, cfg *Config) error
+	// prepare задаёт параметры команды для этого задания
+	prepare func(cfg *Config)
+}
+
+type scheduler struct {
+	sync.Mutex
+	jobs   []*job
+	base   Config
+	jitter time.Duration
+	state  string
+	// httpAddr - listener демона, он не меняется при перечитывании настроек
+	httpAddr string
+}
+
+func newScheduler(cfg *Config) (*scheduler, error) {
+	opts := cfg.daemon
+	s := &scheduler{base: *cfg, jitter: opts.jitter, state: opts.stateFile, httpAddr: cfg.httpAddr}
+	// задания запускают команды сами, собственный HTTP listener есть только у демона
+	s.base.httpAddr = ""
+	var err error
+	add := func(name string, every time.Duration, spec string, run func(ctx context.Context, cfg *Config) error, prepare func(cfg *Config)) {
+		if every <= 0 || err != nil {
+			return
+		}
+		j := &job{Name: name, Every: every, At: spec, run: run, prepare: prepare}
+		if j.at, err = parseJobAt(spec); err != nil {
+			err = fmt.Errorf("Error. -%v-at:%v", name, err)
+			return
+		}
+		s.jobs = append(s.jobs, j)
+	}
+	add("import", opts.importEvery, opts.importAt, runImport, func(c *Config) {})
+	add("rebuild", opts.rebuildEvery, opts.rebuildAt, runRebuild, func(c *Config) {
+		c.rebuild = period{fromStr: "today", toStr: "today"}
+	})
+	if cfg.purge.days > 0 || cfg.purge.before != "" {
+		add("purge", opts.purgeEvery, opts.purgeAt, runPurge, func(c *Config) {})
+	} else {
+		log.Infof("Purge job is disabled: neither -days nor -before is set")
+	}
+	if cfg.quota.file != "" {
+		add("quota", opts.quotaEvery, opts.quotaAt, runQuota, func(c *Config) {})
+	}
+	if cfg.mail.to != "" || cfg.mail.recipients != "" {
+		add("mail", opts.mailEvery, opts.mailAt, runMail, func(c *Config) {
+			c.mail.period = period{fromStr: "yesterday", toStr: "yesterday"}
+		})
+	}
+	add("verify", opts.verifyEvery, opts.verifyAt, runVerify, func(c *Config) {
+		c.verify = verifyOptions{
+			period: period{fromStr: time.Now().AddDate(0, 0, -opts.verifyDays).Format("2006-01-02"), toStr: "yesterday"},
+			logs:   c.fileLog,
+			repair: opts.verifyRepair,
+		}
+	})
+	return s, err
+}
+
+// jobAt - привязка запусков ко времени суток и, для недельных заданий, к дню недели.
+type jobAt struct {
+	weekday int // -1 - любой день
+	clock   time.Duration
+}
+
+// parseJobAt разбирает "HH:MM" или "<день> HH:MM", например "03:00" или "sun 04:00".
+func parseJobAt(spec string) (*jobAt, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	at := &jobAt{weekday: -1}
+	if len(fields) == 2 {
+		day, ok := weekdays[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("bad day %q, expected mon, tue, ...", fields[0])
+		}
+		at.weekday = int(day)
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return nil, fmt.Errorf("bad time %q, expected HH:MM or 'mon HH:MM'", spec)
+	}
+	t, err := time.Parse("15:04", fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad time %q, expected HH:MM or 'mon HH:MM'", spec)
+	}
+	at.clock = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	return at, nil
+}
+
+// next возвращает первый после after запуск из ряда "привязка + k*every".
+// Шаг, кратный суткам, отсчитывается календарными днями, чтобы переход
+// на летнее время не сдвигал ночные запуски.
+func (at *jobAt) next(after time.Time, every time.Duration) time.Time {
+	base := time.Date(after.Year(), after.Month(), after.Day(),
+		int(at.clock/time.Hour), int(at.clock%time.Hour/time.Minute), 0, 0, after.Location())
+	if at.weekday >= 0 {
+		base = base.AddDate(0, 0, -((int(base.Weekday()) - at.weekday + 7) % 7))
+	}
+	const day = 24 * time.Hour
+	if every%day == 0 {
+		days := int(every / day)
+		for base.After(after) {
+			base = base.AddDate(0, 0, -days)
+		}
+		for !base.After(after) {
+			base = base.AddDate(0, 0, days)
+		}
+		return base
+	}
+	next := base.Add(after.Sub(base) / every * every)
+	for next.After(after) {
+		next = next.Add(-every)
+	}
+	for !next.After(after) {
+		next = next.Add(every)
+	}
+	return next
+}
+
+// nextRun - следующий по расписанию запуск после after.
+func (j *job) nextRun(after time.Time) time.Time {
+	if j.at == nil {
+		return after.Add(j.Every)
+	}
+	return j.at.next(after, j.Every)
+}
+
+// schedule назначает первые запуски по сохранённому состоянию.
+func (s *scheduler) schedule() {
+	saved := make(map[string]job)
+	if s.state != "" {
+		if data, err := ioutil.ReadFile(s.state); err == nil {
+			var jobs []job
+			if err := json.Unmarshal(data, &jobs); err != nil {
+				log.Warningf("Error parse schedule state(%v):%v", s.state, err)
+			}
+			for _, j := range jobs {
+				saved[j.Name] = j
+			}
+		} else if !os.IsNotExist(err) {
+			log.Warningf("Error read schedule state(%v):%v", s.state, err)
+		}
+	}
+	s.plan(saved)
+}
+
+// plan назначает запуски с учётом прошлых запусков заданий. Если запуск был
+// пропущен, пока демон не работал, задание выполняется сразу, один раз.
+func (s *scheduler) plan(saved map[string]job) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for _, j := range s.jobs {
+		prev, ok := saved[j.Name]
+		switch {
+		case ok && !prev.LastStart.IsZero():
+			j.LastStart, j.LastEnd, j.LastResult = prev.LastStart, prev.LastEnd, prev.LastResult
+			j.Next = j.nextRun(prev.LastStart)
+			if j.Next.Before(now) {
+				log.Infof("Job %v missed its run at %v, catching up", j.Name, j.Next.Format("2006-01-02 15:04"))
+				j.Next = now
+			}
+		case j.Name == "import" && j.at == nil:
+			j.Next = now
+		default:
+			j.Next = j.nextRun(now)
+		}
+		j.Next = j.Next.Add(s.randomJitter())
+		every := j.Every.String()
+		if j.At != "" {
+			every += " at " + j.At
+		}
+		log.Infof("Job %v every %v, next run at %v", j.Name, every, j.Next.Format("2006-01-02 15:04:05"))
+	}
+}
+
+func (s *scheduler) randomJitter() time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.jitter)))
+}
+
+// reload перечитывает настройки по SIGHUP и строит расписание заново.
+// Прошлые запуски заданий сохраняются, listener демона не меняется.
+func (s *scheduler) reload() {
+	var fresh Config
+	if _, err := parseCommandLine(os.Args[1:], &fresh); err != nil {
+		log.Errorf("Error reload config, keeping the current one:%v", err)
+		return
+	}
+	if err := setupAndValidate(&fresh); err != nil {
+		log.Errorf("Error reload config, keeping the current one:%v", err)
+		return
+	}
+	if fresh.httpAddr != s.httpAddr {
+		log.Warningf("Option http-addr has changed, it will take effect after restart")
+	}
+	next, err := newScheduler(&fresh)
+	if err != nil {
+		log.Errorf("Error reload config, keeping the current one:%v", err)
+		return
+	}
+	if len(next.jobs) == 0 {
+		log.Errorf("Error reload config, keeping the current one: all jobs are disabled")
+		return
+	}
+	saved := make(map[string]job)
+	for _, j := range s.snapshot() {
+		saved[j.Name] = j
+	}
+	s.Lock()
+	s.jobs, s.base, s.jitter, s.state = next.jobs, next.base, next.jitter, next.state
+	s.Unlock()
+	log.Infof("Config reloaded")
+	s.plan(saved)
+	s.save()
+}
+
+// nextJob возвращает задание, которое нужно выполнить раньше остальных.
+func (s *scheduler) nextJob() *job {
+	s.Lock()
+	defer s.Unlock()
+	var next *job
+	for _, j := range s.jobs {
+		if next == nil || j.Next.Before(next.Next) {
+			next = j
+		}
+	}
+	return next
+}
+
+// loop выполняет задания по одному до отмены ctx.
+func (s *scheduler) loop(ctx context.Context) error {
+	for {
+		j := s.nextJob()
+		if j == nil {
+			return fmt.Errorf("Error. All jobs are disabled")
+		}
+		if wait := time.Until(j.Next); wait > 0 {
+			// просыпаемся и для heartbeat watchdog'а
+			if heartbeat.interval > 0 && heartbeat.interval < wait {
+				wait = heartbeat.interval
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-reloadRequests:
+				s.reload()
+			case <-time.After(wait):
+			}
+			heartbeat.alive()
+			// после перечитывания расписание другое, задание выбирается заново
+			continue
+		}
+		if err := s.runJob(ctx, j); errors.Is(err, errInterrupted) {
+			return err
+		}
+	}
+}
+
+func (s *scheduler) runJob(ctx context.Context, j *job) error {
+	id := newRunID()
+	s.Lock()
+	j.Running = true
+	j.LastStart = time.Now()
+	j.LastRun = id
+	s.Unlock()
+
+	// Задания идут по одному, поэтому сообщения задания помечаются его ID,
+	// а собственные сообщения планировщика - ID демона.
+	daemonRun := currentRunID()
+	jobLog := log.WithFields(log.Fields{"run": id, "job": j.Name})
+	jobLog.Infof("Job %v started", j.Name)
+	cfg := s.base
+	cfg.startTime = j.LastStart
+	j.prepare(&cfg)
+	setRunID(id)
+	err := j.run(ctx, &cfg)
+	setRunID(daemonRun)
+
+	s.Lock()
+	j.Running = false
+	j.LastEnd = time.Now()
+	j.LastResult = "ok"
+	if err != nil {
+		j.LastResult = err.Error()
+	}
+	// пропущенные за время долгого задания запуски не накапливаются
+	j.Next = j.nextRun(j.LastStart)
+	if j.Next.Before(j.LastEnd) {
+		j.Next = j.LastEnd
+		if j.at != nil {
+			j.Next = j.nextRun(j.LastEnd)
+		}
+	}
+	j.Next = j.Next.Add(s.randomJitter())
+	s.Unlock()
+
+	if err != nil {
+		jobLog.Errorf("Job %v failed in %.8v:%v", j.Name, j.LastEnd.Sub(j.LastStart), err)
+	} else {
+		jobLog.Infof("Job %v finished in %.8v", j.Name, j.LastEnd.Sub(j.LastStart))
+	}
+	log.Infof("Job %v next run at %v", j.Name, j.Next.Format("2006-01-02 15:04:05"))
+	s.save()
+	return err
+}
+
+// snapshot - копия заданий для /jobs и файла состояния.
+func (s *scheduler) snapshot() []job {
+	s.Lock()
+	defer s.Unlock()
+	jobs := make([]job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+func (s *scheduler) save() {
+	if s.state == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.snapshot(), "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := s.state + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Error write schedule state(%v):%v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, s.state); err != nil {
+		log.Errorf("Error rename schedule state(%v):%v", tmp, err)
+	}
+}
+
+func runDaemon(ctx context.Context, cfg *Config) error {
+	sched, err := newScheduler(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Соединение демона нужно только для /readyz, задания открывают свои.
+	if cfg.httpAddr != "" {
+		store, err := openStore(ctx, cfg, false)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		mux, err := serveHTTP(cfg, store)
+		if err != nil {
+			return err
+		}
+		mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(sched.snapshot())
+		})
+	}
+
+	handleControlSignals(true)
+	setupWatchdog(cfg)
+	sched.schedule()
+	if err := sdNotify("READY=1\nSTATUS=Waiting for the next job"); err != nil {
+		log.Warningf("Error sd_notify:%v", err)
+	}
+	return sched.loop(ctx)
+}
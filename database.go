@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql" // ....
 	_ "github.com/lib/pq"              // ...
@@ -12,18 +13,53 @@ func newStore(db *sql.DB) *transport {
 	return &transport{
 		db:       db,
 		lines:    make([]lineOfLogType, 0),
-		exitChan: getExitSignalsChannel(),
+		retry: retryPolicy{
+			attempts: 5,
+			delay:    time.Second,
+			maxDelay: time.Minute,
+		},
 	}
 }
 
-func newDB(typedb, databaseURL string) (*sql.DB, error) {
+// newDB открывает БД и ждёт, пока она станет доступна, повторяя Ping
+// по policy, если ошибка временная (например, MySQL ещё перезапускается).
+func newDB(typedb, databaseURL string, policy retryPolicy) (*sql.DB, error) {
 	db, err := sql.Open(typedb, databaseURL)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Ping(); err != nil {
+	if err := policy.do("connecting to DB", db.Ping); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
+
+func (s *transport) exec(op, query string, args ...interface{}) error {
+	return s.retry.do(op, func() error {
+		_, err := s.db.Exec(query, args...)
+		return err
+	})
+}
+
+// execAffected выполняет запрос с повторами и возвращает число изменённых строк.
+func (s *transport) execAffected(op, query string, args ...interface{}) (int64, error) {
+	var affected int64
+	err := s.retry.do(op, func() error {
+		result, err := s.db.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		affected, err = result.RowsAffected()
+		return err
+	})
+	return affected, err
+}
+
+// tableExists проверяет наличие необязательной таблицы go-fetch.
+func (s *transport) tableExists(table string) bool {
+	var n int
+	err := s.db.QueryRow("select 1 from " + table + " limit 1").Scan(&n)
+	return err == nil || err == sql.ErrNoRows
+}
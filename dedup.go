@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// deduper отсеивает строки, уже загруженные ранее, например при пересекающихся
+// файлах (access.log и его копия access.log.1) или повторном запуске.
+// Отпечаток строки запоминается только после успешной вставки.
+type deduper interface {
+	// seen проверяет отпечатки пакета строк разом, dup[i] относится к hashes[i]
+	seen(hashes []string) (dup []bool, err error)
+	add(hash, date string)
+	// save сохраняет новые отпечатки в той же транзакции, что и перенос в scsq_traffic,
+	// saved вызывается после её фиксации.
+	save(tx *sql.Tx) error
+	saved()
+}
+
+func newDeduper(cfg *Config, s *transport) (deduper, error) {
+	switch cfg.dedupType {
+	case "", "none":
+		return nil, nil
+	case "index":
+		if err := s.exec("creating scsq_dedup", dedupTableDDL); err != nil {
+			return nil, err
+		}
+		return &indexDeduper{s: s, numProxy: cfg.NumPrnoxy, pending: make(map[string]string)}, nil
+	case "bloom":
+		return newBloomDeduper(cfg.dedupSize, 0.001), nil
+	}
+	return nil, fmt.Errorf("Error. dedup must be 'none', 'index' or 'bloom', not '%v'", cfg.dedupType)
+}
+
+// lineHash - отпечаток строки по прокси, времени, клиенту, адресу, объёму, статусу и длительности.
+func lineHash(v lineOfLogType, numProxy int) string {
+	sum := md5.Sum([]byte(strconv.Itoa(numProxy) + "|" + v.date + "|" + v.ipaddress + "|" + v.siteName + "|" +
+		v.sizeInBytes + "|" + v.httpstatus + "|" + v.elapsed))
+	return hex.EncodeToString(sum[:])
+}
+
+const dedupTableDDL = `CREATE TABLE IF NOT EXISTS scsq_dedup (
+	hash char(32) NOT NULL,
+	date int NOT NULL,
+	numproxy int NOT NULL,
+	PRIMARY KEY (hash),
+	KEY date (date)
+)`
+
+// indexDeduper хранит отпечатки в таблице scsq_dedup с уникальным ключом.
+type indexDeduper struct {
+	s        *transport
+	numProxy int
+	// pending - отпечатки строк, ещё не перенесённых в scsq_traffic
+	pending map[string]string
+}
+
+// dedupChunk - сколько отпечатков проверяется одним запросом
+const dedupChunk = 500
+
+func (d *indexDeduper) seen(hashes []string) ([]bool, error) {
+	found := make(map[string]bool)
+	var query []string
+	for _, hash := range hashes {
+		if _, ok := d.pending[hash]; ok {
+			found[hash] = true
+		} else {
+			query = append(query, hash)
+		}
+	}
+	for len(query) > 0 {
+		chunk := query
+		if len(chunk) > dedupChunk {
+			chunk = chunk[:dedupChunk]
+		}
+		query = query[len(chunk):]
+		args := make([]interface{}, len(chunk))
+		for i, hash := range chunk {
+			args[i] = hash
+		}
+		err := d.s.retry.do("checking scsq_dedup", func() error {
+			rows, err := d.s.db.Query("select hash from scsq_dedup where hash in (?"+strings.Repeat(",?", len(chunk)-1)+")", args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var hash string
+				if err := rows.Scan(&hash); err != nil {
+					return err
+				}
+				found[hash] = true
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	dup := make([]bool, len(hashes))
+	for i, hash := range hashes {
+		dup[i] = found[hash]
+	}
+	return dup, nil
+}
+
+func (d *indexDeduper) add(hash, date string) {
+	d.pending[hash] = date
+}
+
+func (d *indexDeduper) save(tx *sql.Tx) error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare("insert ignore into scsq_dedup (hash, date, numproxy) values (?, floor(?), ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for hash, date := range d.pending {
+		if _, err := stmt.Exec(hash, date, d.numProxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *indexDeduper) saved() {
+	d.pending = make(map[string]string)
+}
+
+// bloomDeduper - фильтр Блума в памяти процесса. Размер ограничен заранее,
+// цена - небольшая доля ложных срабатываний, при которых строка будет пропущена.
+type bloomDeduper struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+func newBloomDeduper(n int, p float64) *bloomDeduper {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Ceil(float64(m) / float64(n) * math.Ln2))
+	return &bloomDeduper{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// positions даёт k позиций двойным хешированием.
+func (b *bloomDeduper) positions(hash string) []uint64 {
+	h := fnv.New128a()
+	h.Write([]byte(hash))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:]) | 1
+	pos := make([]uint64, b.k)
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % b.m
+	}
+	return pos
+}
+
+func (b *bloomDeduper) seen(hashes []string) ([]bool, error) {
+	dup := make([]bool, len(hashes))
+	for i, hash := range hashes {
+		dup[i] = b.has(hash)
+	}
+	return dup, nil
+}
+
+func (b *bloomDeduper) has(hash string) bool {
+	for _, p := range b.positions(hash) {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomDeduper) add(hash, date string) {
+	for _, p := range b.positions(hash) {
+		b.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+func (b *bloomDeduper) save(tx *sql.Tx) error {
+	return nil
+}
+
+func (b *bloomDeduper) saved() {}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLineHash(t *testing.T) {
+	base := lineOfLogType{
+		date: "1600000000.123", elapsed: "150", ipaddress: "10.0.0.5", httpstatus: "TCP_MISS/200",
+		sizeInBytes: "5120", method: "GET", siteName: "http://example.com/", login: "alice", mime: "text/html",
+	}
+	want := lineHash(base, 1)
+	if len(want) != 32 {
+		t.Fatalf("hash %q is not 32 hex digits", want)
+	}
+	tests := []struct {
+		name     string
+		change   func(v *lineOfLogType)
+		numProxy int
+		same     bool
+	}{
+		{"same line", func(v *lineOfLogType) {}, 1, true},
+		// логин и mime могут отличаться при повторной записи той же строки
+		{"login", func(v *lineOfLogType) { v.login = "bob" }, 1, true},
+		{"mime", func(v *lineOfLogType) { v.mime = "-" }, 1, true},
+		{"raw", func(v *lineOfLogType) { v.raw, v.offset = "raw", 10 }, 1, true},
+		{"proxy", func(v *lineOfLogType) {}, 2, false},
+		{"date", func(v *lineOfLogType) { v.date = "1600000000.124" }, 1, false},
+		{"ip", func(v *lineOfLogType) { v.ipaddress = "10.0.0.6" }, 1, false},
+		{"site", func(v *lineOfLogType) { v.siteName = "http://example.org/" }, 1, false},
+		{"size", func(v *lineOfLogType) { v.sizeInBytes = "5121" }, 1, false},
+		{"status", func(v *lineOfLogType) { v.httpstatus = "TCP_HIT/200" }, 1, false},
+		{"elapsed", func(v *lineOfLogType) { v.elapsed = "151" }, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := base
+			tt.change(&v)
+			if got := lineHash(v, tt.numProxy); (got == want) != tt.same {
+				t.Errorf("got %v, base %v, want same=%v", got, want, tt.same)
+			}
+		})
+	}
+}
+
+func TestBloomDeduper(t *testing.T) {
+	const n = 10000
+	b := newBloomDeduper(n, 0.001)
+	var added []string
+	for i := 0; i < n; i++ {
+		hash := fmt.Sprintf("added-%v", i)
+		b.add(hash, "")
+		added = append(added, hash)
+	}
+	dup, err := b.seen(added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range dup {
+		if !d {
+			t.Fatalf("%v was added but not seen", added[i])
+		}
+	}
+
+	// ложные срабатывания не должны заметно превышать заданную долю
+	var fresh []string
+	for i := 0; i < n; i++ {
+		fresh = append(fresh, fmt.Sprintf("fresh-%v", i))
+	}
+	dup, err = b.seen(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var falsePositives int
+	for _, d := range dup {
+		if d {
+			falsePositives++
+		}
+	}
+	if falsePositives > n/200 {
+		t.Errorf("%v false positives of %v", falsePositives, n)
+	}
+
+	if empty := newBloomDeduper(0, 0.001); empty.has("x") {
+		t.Error("an empty filter has seen a hash")
+	}
+}
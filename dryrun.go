@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxSamples = 3
+	// maxOldSamples - сколько пропускаемых как старые строк показать
+	maxOldSamples = 20
+)
+
+// logSample - строка лога и смещение её начала в файле.
+type logSample struct {
+	offset int64
+	line   string
+}
+
+type rejectReason struct {
+	count   int
+	samples []logSample
+}
+
+// parseReport - итог разбора лога в режиме dry-run.
+type parseReport struct {
+	total    int
+	parsed   int
+	empty    int
+	rejected int
+	tooOld   int
+	old      []logSample
+	reasons  map[string]*rejectReason
+	minDate  float64
+	maxDate  float64
+	users    map[string]struct{}
+	ips      map[string]struct{}
+	sites    map[string]struct{}
+	lastDate string
+}
+
+func newParseReport(lastDate string) *parseReport {
+	return &parseReport{
+		reasons:  make(map[string]*rejectReason),
+		users:    make(map[string]struct{}),
+		ips:      make(map[string]struct{}),
+		sites:    make(map[string]struct{}),
+		lastDate: lastDate,
+	}
+}
+
+func (r *parseReport) add(line string, offset int64) {
+	r.total++
+	if line == "" {
+		r.empty++
+		return
+	}
+	lineOut, err := parseLineToStruct(replaceQuotes(line))
+	if err != nil {
+		r.rejected++
+		reason, ok := r.reasons[err.Error()]
+		if !ok {
+			reason = &rejectReason{}
+			r.reasons[err.Error()] = reason
+		}
+		reason.count++
+		if len(reason.samples) < maxSamples {
+			reason.samples = append(reason.samples, logSample{offset, line})
+		}
+		return
+	}
+	r.parsed++
+	if r.lastDate > lineOut.date {
+		r.tooOld++
+		if len(r.old) < maxOldSamples {
+			r.old = append(r.old, logSample{offset, line})
+		}
+	}
+	date, _ := strconv.ParseFloat(lineOut.date, 64)
+	if r.minDate == 0 || date < r.minDate {
+		r.minDate = date
+	}
+	if date > r.maxDate {
+		r.maxDate = date
+	}
+	r.users[lineOut.login] = struct{}{}
+	r.ips[lineOut.ipaddress] = struct{}{}
+	r.sites[siteHost(lineOut.siteName)] = struct{}{}
+}
+
+func (r *parseReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Lines total:    %v\n", r.total)
+	fmt.Fprintf(w, "Lines empty:    %v\n", r.empty)
+	fmt.Fprintf(w, "Lines parsed:   %v\n", r.parsed)
+	fmt.Fprintf(w, "Lines rejected: %v\n", r.rejected)
+
+	reasons := make([]string, 0, len(r.reasons))
+	for reason := range r.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		return r.reasons[reasons[i]].count > r.reasons[reasons[j]].count
+	})
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %v: %v\n", reason, r.reasons[reason].count)
+		for _, sample := range r.reasons[reason].samples {
+			fmt.Fprintf(w, "    offset %v: %q\n", sample.offset, sample.line)
+		}
+	}
+
+	if r.parsed > 0 {
+		fmt.Fprintf(w, "Time range:     %v - %v\n",
+			unixToTime(r.minDate).Format("2006-01-02 15:04:05"),
+			unixToTime(r.maxDate).Format("2006-01-02 15:04:05"))
+	}
+	fmt.Fprintf(w, "Distinct users: %v\n", len(r.users))
+	fmt.Fprintf(w, "Distinct IPs:   %v\n", len(r.ips))
+	fmt.Fprintf(w, "Distinct sites: %v\n", len(r.sites))
+	if r.lastDate == "" {
+		fmt.Fprintf(w, "Too old:        unknown (last date in DB is not available)\n")
+	} else {
+		fmt.Fprintf(w, "Too old:        %v (older than %v in DB, will be skipped)\n", r.tooOld, r.lastDate)
+		for _, sample := range r.old {
+			fmt.Fprintf(w, "    offset %v: %q\n", sample.offset, sample.line)
+		}
+		if r.tooOld > len(r.old) {
+			fmt.Fprintf(w, "    ... and %v more\n", r.tooOld-len(r.old))
+		}
+	}
+}
+
+// dryRun разбирает лог целиком, ничего не записывая в БД.
+// Из БД (если она доступна) читается только дата последней записи.
+func dryRun(ctx context.Context, cfg *Config) error {
+	lastDate := ""
+	db, err := newDB(cfg.typedb, cfg.SQLAddr, retryPolicy{})
+	if err != nil {
+		log.Warningf("DB is not available, skipping the check for old lines:%v", err)
+	} else {
+		lastDate = (&transport{db: db}).readLastDate(cfg.NumPrnoxy)
+		db.Close()
+	}
+
+	reader, err := openLogReader(cfg.fileLog, 0, false)
+	if err != nil {
+		return fmt.Errorf("Error opening squid log file(%v):%v", cfg.fileLog, err)
+	}
+	defer reader.Close()
+
+	report := newParseReport(lastDate)
+	for ctx.Err() == nil {
+		line, err := reader.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		report.add(line, reader.lineStart)
+	}
+	report.print(os.Stdout)
+	return nil
+}
+
+func unixToTime(date float64) time.Time {
+	sec := int64(date)
+	return time.Unix(sec, int64((date-float64(sec))*1e9))
+}
+
+// siteHost оставляет от адреса только имя хоста.
+func siteHost(site string) string {
+	if i := strings.Index(site, "://"); i >= 0 {
+		site = site[i+3:]
+	}
+	if i := strings.IndexAny(site, "/?"); i >= 0 {
+		site = site[:i]
+	}
+	return site
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseReportTooOld(t *testing.T) {
+	r := newParseReport("1600000100.000")
+	var offset int64
+	add := func(line string) {
+		r.add(line, offset)
+		offset += int64(len(line)) + 1
+	}
+	for i := 0; i < maxOldSamples+2; i++ {
+		add(fmt.Sprintf("1600000000.%03d 1 10.0.0.5 TCP_MISS/200 10 GET http://old/ - DIRECT/1.2.3.4 -", i))
+	}
+	add("1600000200.000 1 10.0.0.5 TCP_MISS/200 10 GET http://new/ - DIRECT/1.2.3.4 -")
+	add("garbage")
+
+	if r.tooOld != maxOldSamples+2 || len(r.old) != maxOldSamples {
+		t.Fatalf("tooOld %v, samples %v", r.tooOld, len(r.old))
+	}
+	if r.old[1].offset != int64(len(r.old[0].line))+1 {
+		t.Errorf("offset of the second sample %v", r.old[1].offset)
+	}
+
+	var buf bytes.Buffer
+	r.print(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		fmt.Sprintf("Too old:        %v (older than 1600000100.000 in DB, will be skipped)", maxOldSamples+2),
+		`    offset 0: "1600000000.000 1 10.0.0.5`,
+		"    ... and 2 more",
+		"  " + errTooFewFields.Error() + ": 1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in\n%v", want, out)
+		}
+	}
+	if strings.Contains(out, "http://new/") {
+		t.Errorf("a new line is shown as too old:\n%v", out)
+	}
+}
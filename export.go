@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+type exportOptions struct {
+	period period
+	format string
+	output string
+}
+
+func exportFlags(fs *flag.FlagSet, cfg *Config) {
+	periodFlags(fs, &cfg.export.period, "today", "today")
+	fs.StringVar(&cfg.export.format, "format", "csv", "Output format: 'csv' or 'json' (one object per line)")
+	fs.StringVar(&cfg.export.output, "o", "-", "Output file, '-' for stdout")
+}
+
+type exportRow struct {
+	Date        string `json:"date"`
+	IPAddress   string `json:"ipaddress"`
+	Login       string `json:"login"`
+	HTTPStatus  string `json:"httpstatus"`
+	SizeInBytes string `json:"sizeinbytes"`
+	Site        string `json:"site"`
+	Method      string `json:"method"`
+	Mime        string `json:"mime"`
+}
+
+func runExport(ctx context.Context, cfg *Config) error {
+	opts := &cfg.export
+	if opts.format != "csv" && opts.format != "json" {
+		return fmt.Errorf("Error. format must be 'csv' or 'json'")
+	}
+	if err := opts.period.parse(); err != nil {
+		return err
+	}
+
+	store, err := openStore(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var out io.Writer = os.Stdout
+	if opts.output != "-" {
+		file, err := os.Create(opts.output)
+		if err != nil {
+			return fmt.Errorf("Error open file(%v):%v", opts.output, err)
+		}
+		defer file.Close()
+		out = file
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	rows, err := store.db.QueryContext(ctx, `select t.date, coalesce(ip.name,''), coalesce(l.name,''), coalesce(h.name,''),
+		t.sizeinbytes, t.site, t.method, t.mime
+	from scsq_traffic t
+	left join scsq_ipaddress ip on t.ipaddress=ip.id
+	left join scsq_logins l on t.login=l.id
+	left join scsq_httpstatus h on t.httpstatus=h.id
+	where t.date>=? and t.date<? and t.numproxy=?
+	order by t.date`, opts.period.from.Unix(), opts.period.to.Unix(), cfg.NumPrnoxy)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	csvw := csv.NewWriter(w)
+	enc := json.NewEncoder(w)
+	if opts.format == "csv" {
+		csvw.Write([]string{"date", "ipaddress", "login", "httpstatus", "sizeinbytes", "site", "method", "mime"})
+	}
+	for rows.Next() {
+		var r exportRow
+		if err := rows.Scan(&r.Date, &r.IPAddress, &r.Login, &r.HTTPStatus, &r.SizeInBytes, &r.Site, &r.Method, &r.Mime); err != nil {
+			return err
+		}
+		if opts.format == "csv" {
+			err = csvw.Write([]string{r.Date, r.IPAddress, r.Login, r.HTTPStatus, r.SizeInBytes, r.Site, r.Method, r.Mime})
+		} else {
+			err = enc.Encode(r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	csvw.Flush()
+	if err := csvw.Error(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errNoData возвращается в режиме follow, когда новых строк в файле пока нет.
+var errNoData = errors.New("no new data")
+
+// logReader читает лог построчно и считает смещение в байтах.
+// В режиме follow при достижении конца файла ждёт новые строки
+// и переоткрывает файл после ротации.
+type logReader struct {
+	name    string
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64
+	follow  bool
+	partial string
+	// draining - файл по имени уже заменён, дочитываем старый дескриптор
+	draining bool
+	// lineStart - смещение начала последней прочитанной строки
+	lineStart int64
+	// firstLine - отпечаток первой строки открытого файла для checkpoint'а
+	firstLine string
+}
+
+func openLogReader(name string, offset int64, follow bool) (*logReader, error) {
+	r := &logReader{
+		name:   name,
+		follow: follow,
+	}
+	if err := r.open(offset); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *logReader) open(offset int64) error {
+	file, err := os.Open(r.name)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = file
+	r.reader = bufio.NewReader(file)
+	r.offset = offset
+	r.partial = ""
+	r.firstLine = ""
+	return nil
+}
+
+// head возвращает отпечаток первой строки файла, который сейчас читается.
+func (r *logReader) head() string {
+	if r.firstLine == "" {
+		r.firstLine = fileHead(r.file)
+	}
+	return r.firstLine
+}
+
+// readLine возвращает очередную строку без перевода строки.
+// Смещение сдвигается только на полностью прочитанные строки.
+func (r *logReader) readLine() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err == nil {
+		line = r.partial + line
+		r.partial = ""
+		r.lineStart = r.offset
+		r.offset += int64(len(line))
+		return trimEOL(line), nil
+	}
+	if err != io.EOF {
+		return "", err
+	}
+	r.partial += line
+	if r.follow && !r.draining {
+		if !r.rotated() {
+			return "", errNoData
+		}
+		// Файл заменён или обрезан: сначала дочитываем старый дескриптор до конца,
+		// в него могли дописать строки после предыдущей проверки.
+		r.draining = true
+		return r.readLine()
+	}
+	if !r.draining {
+		// Строку без перевода строки squid может ещё дописывать: её не отдаём
+		// и смещение за неё не сдвигаем, следующий запуск прочитает её целиком.
+		return "", io.EOF
+	}
+	// Старый файл после ротации больше не пишется: хвост - последняя строка
+	if r.partial != "" {
+		line = r.partial
+		r.partial = ""
+		r.lineStart = r.offset
+		r.offset += int64(len(line))
+		return trimEOL(line), nil
+	}
+	log.Infof("File %v was rotated, reopening", r.name)
+	r.draining = false
+	if err := r.open(0); err != nil {
+		return "", err
+	}
+	return r.readLine()
+}
+
+// rotated проверяет, что по имени файла теперь лежит другой файл
+// или текущий файл был обрезан.
+func (r *logReader) rotated() bool {
+	stat, err := os.Stat(r.name)
+	if err != nil {
+		return false
+	}
+	cur, err := r.file.Stat()
+	if err != nil {
+		return true
+	}
+	if !os.SameFile(stat, cur) {
+		return true
+	}
+	return stat.Size() < r.offset
+}
+
+func (r *logReader) Close() error {
+	return r.file.Close()
+}
+
+func trimEOL(line string) string {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func appendFile(t *testing.T, name, data string) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAvailable читает строки до errNoData или io.EOF.
+func readAvailable(t *testing.T, r *logReader) (lines []string, last error) {
+	t.Helper()
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestLogReaderFollow(t *testing.T) {
+	tests := []struct {
+		name string
+		// rotate меняет файл после того, как прочитаны a и b, а "part" дописана до "partial"
+		rotate func(t *testing.T, name string)
+		want   []string
+	}{
+		{
+			name: "rename",
+			rotate: func(t *testing.T, name string) {
+				if err := os.Rename(name, name+".1"); err != nil {
+					t.Fatal(err)
+				}
+				// squid дописывает в старый файл, пока не переоткроет лог
+				appendFile(t, name+".1", "c\nd")
+				appendFile(t, name, "e\n")
+			},
+			want: []string{"partial", "c", "d", "e"},
+		},
+		{
+			name: "copytruncate",
+			rotate: func(t *testing.T, name string) {
+				if err := os.Truncate(name, 0); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, name, "e\n")
+			},
+			// дописанное после копирования теряется вместе с обрезанным файлом,
+			// прочитанный ранее хвост отдаётся как есть
+			want: []string{"part", "e"},
+		},
+		{
+			name: "no rotation",
+			rotate: func(t *testing.T, name string) {
+				appendFile(t, name, "c\n")
+			},
+			want: []string{"partial", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(tempDir(t), "access.log")
+			appendFile(t, name, "a\nb\npart")
+			r, err := openLogReader(name, 0, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			lines, err := readAvailable(t, r)
+			if err != errNoData || !reflect.DeepEqual(lines, []string{"a", "b"}) {
+				t.Fatalf("got %q, %v", lines, err)
+			}
+			// недописанная строка не сдвигает смещение
+			if r.offset != 4 {
+				t.Errorf("offset %v, want 4", r.offset)
+			}
+			appendFile(t, name, "ial\n")
+			tt.rotate(t, name)
+
+			lines, err = readAvailable(t, r)
+			if err != errNoData || !reflect.DeepEqual(lines, tt.want) {
+				t.Errorf("got %q, %v, want %q", lines, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogReaderEOF(t *testing.T) {
+	name := filepath.Join(tempDir(t), "access.log")
+	appendFile(t, name, "a\nb\nc")
+	r, err := openLogReader(name, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	lines, err := readAvailable(t, r)
+	// "c" ещё дописывается: она не читается, и смещение остаётся перед ней
+	if err != io.EOF || !reflect.DeepEqual(lines, []string{"b"}) {
+		t.Errorf("got %q, %v", lines, err)
+	}
+	if r.offset != 4 {
+		t.Errorf("offset %v, want 4", r.offset)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -24,15 +25,19 @@ func getExitSignalsChannel() chan os.Signal {
 
 }
 
-func (t *transport) Exit() {
-	<-t.exitChan
-	t.db.Close()
-	if err := os.Remove(config.PIDFileName); err != nil {
-		log.Errorf("Error remove file(%v):%v", config.PIDFileName, err)
-	} else {
-		log.Debugf("PID file(%v) has been successfully deleted", config.PIDFileName)
-	}
-	log.Println("Shutting down")
-	os.Exit(0)
-
+// shutdownContext отменяется по первому сигналу: команда дописывает текущий
+// пакет, сохраняет checkpoint и завершается с ошибкой errInterrupted.
+// Второй сигнал останавливает процесс сразу, блокировку снимет ядро.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := getExitSignalsChannel()
+	go func() {
+		sig := <-c
+		log.Warningf("Got %v, shutting down after the current batch. Send it again to stop immediately", sig)
+		cancel()
+		sig = <-c
+		log.Errorf("Got %v again, stopping immediately", sig)
+		os.Exit(2)
+	}()
+	return ctx
 }
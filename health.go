@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// statusDoc - документ /status. Заменяет чтение строки прогресса в терминале.
+type statusDoc struct {
+	Proxy          int       `json:"proxy"`
+	Started        time.Time `json:"started"`
+	File           string    `json:"file"`
+	Offset         int64     `json:"offset"`
+	CommittedFile  string    `json:"committed_file,omitempty"`
+	CommittedOff   int64     `json:"committed_offset"`
+	LagBytes       int64     `json:"lag_bytes"`
+	LinesRead      int64     `json:"lines_read"`
+	LinesAdded     int64     `json:"lines_added"`
+	LinesDuplicate int64     `json:"lines_duplicate"`
+	LinesRejected  int64     `json:"lines_rejected"`
+	LinesPerSec    float64   `json:"lines_per_sec"`
+	LastBatch      time.Time `json:"last_batch,omitempty"`
+	LastBatchError string    `json:"last_batch_error,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	LastErrorTime  time.Time `json:"last_error_time,omitempty"`
+}
+
+func (m *metricSet) status() statusDoc {
+	m.Lock()
+	defer m.Unlock()
+	doc := statusDoc{
+		Proxy:          m.proxy,
+		Started:        m.started,
+		File:           m.readFile,
+		Offset:         m.readOffset,
+		CommittedFile:  m.file,
+		CommittedOff:   m.offset,
+		LinesRead:      m.linesRead,
+		LinesAdded:     m.linesAdded,
+		LinesDuplicate: m.linesDuplicate,
+		LastBatch:      m.lastBatch,
+		LastBatchError: m.lastBatchErr,
+		LastError:      m.lastError,
+		LastErrorTime:  m.lastErrorTime,
+	}
+	for _, n := range m.rejected {
+		doc.LinesRejected += n
+	}
+	if since := time.Since(m.started).Seconds(); since > 0 {
+		doc.LinesPerSec = float64(m.linesRead) / since
+	}
+	doc.LagBytes, _ = m.lagBytes()
+	return doc
+}
+
+// healthHandlers добавляет /healthz (процесс жив), /readyz (БД доступна,
+// отставание checkpoint'а в пределах -ready-max-lag, последний пакет записан)
+// и /status.
+func healthHandlers(mux *http.ServeMux, cfg *Config, s *transport) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		var problems []string
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := s.db.PingContext(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("DB is unreachable: %v", err))
+		}
+		doc := metrics.status()
+		if doc.LagBytes > cfg.readyMaxLag {
+			problems = append(problems, fmt.Sprintf("checkpoint lag %v bytes exceeds %v", doc.LagBytes, cfg.readyMaxLag))
+		}
+		if doc.LastBatchError != "" {
+			problems = append(problems, "last batch failed: "+doc.LastBatchError)
+		}
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(metrics.status())
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Режим external_acl_type для Squid. Helper отвечает OK, если пользователь
+// превысил квоту (ACL срабатывает и запрос запрещается), и ERR, если нет:
+//
+//	external_acl_type e_block ttl=10 negative_ttl=10 %LOGIN /usr/bin/go-fetch helper -daily-quota 1024
+//	acl a_block external e_block
+//	http_access deny a_block
+//
+// С -quotas helper проверяет квоты из того же файла, что и команда quota, по
+// scsq_quota_state, которую она заполняет. -concurrency должен совпадать с
+// concurrency= в external_acl_type: тогда каждый запрос начинается с номера канала.
+//
+// stdout занят протоколом Squid, поэтому лог go-fetch пишется только в stderr или -log-file.
+
+type helperOptions struct {
+	by           string
+	dailyQuota   int64
+	monthlyQuota int64
+	concurrency  int
+	ttl          int
+	queryTimeout time.Duration
+}
+
+func helperFlags(fs *flag.FlagSet, cfg *Config) {
+	opts := &cfg.helper
+	fs.StringVar(&opts.by, "by", "login", `What Squid passes to the helper:
+		'login' - %LOGIN,
+		'ip' - %SRC`)
+	fs.Int64Var(&opts.dailyQuota, "daily-quota", 0, "Daily quota in megabytes, 0 - unlimited")
+	fs.Int64Var(&opts.monthlyQuota, "monthly-quota", 0, "Monthly quota in megabytes, 0 - unlimited")
+	fs.IntVar(&opts.concurrency, "concurrency", 0, "Value of concurrency= in external_acl_type, with >0 every request starts with a channel-ID")
+	fs.StringVar(&cfg.quota.file, "quotas", "", "File with quota definitions, checked by scsq_quota_state that 'go-fetch quota' fills")
+	fs.IntVar(&opts.ttl, "ttl", 300, "Defines the time after which data from the database will be updated in seconds")
+	fs.DurationVar(&opts.queryTimeout, "query-timeout", 5*time.Second, "Timeout of a DB query for one user")
+}
+
+// userTraffic - потребление пользователя в байтах, запомненное в кэше.
+type userTraffic struct {
+	day        int64
+	month      int64
+	over       string // имя превышенной квоты из -quotas
+	fetched    time.Time
+	refreshing bool
+}
+
+type quotaHelper struct {
+	sync.Mutex
+	cfg    *Config
+	quotas *quotaSet
+	cache  map[string]*userTraffic
+
+	connMu      sync.Mutex
+	s           *transport
+	lastConnect time.Time
+
+	outMu sync.Mutex
+	out   *bufio.Writer
+}
+
+func runHelper(ctx context.Context, cfg *Config) error {
+	opts := &cfg.helper
+	if opts.by != "login" && opts.by != "ip" {
+		return fmt.Errorf("Error. by must be 'login' or 'ip'")
+	}
+	if opts.concurrency < 0 {
+		return fmt.Errorf("Error. concurrency must not be negative")
+	}
+	h := &quotaHelper{
+		cfg:   cfg,
+		cache: make(map[string]*userTraffic),
+		out:   bufio.NewWriter(os.Stdout),
+	}
+	if cfg.quota.file != "" {
+		set, err := readQuotas(cfg.quota.file)
+		if err != nil {
+			return err
+		}
+		h.quotas = set
+	} else if opts.dailyQuota <= 0 && opts.monthlyQuota <= 0 {
+		log.Warningf("Neither -quotas nor -daily-quota nor -monthly-quota is set, every user is within quota")
+	}
+	defer func() {
+		if h.s != nil {
+			h.s.Close()
+		}
+	}()
+	return h.serve(ctx, os.Stdin)
+}
+
+// store подключается к БД при первом запросе. Helper не завершается, если БД
+// недоступна: Squid останавливается, когда helper'ы падают слишком часто.
+// Повторное подключение - не чаще раза в -ttl, без повторов запросов,
+// чтобы не задерживать ответы.
+func (h *quotaHelper) store() (*transport, error) {
+	h.connMu.Lock()
+	defer h.connMu.Unlock()
+	if h.s != nil {
+		return h.s, nil
+	}
+	if time.Since(h.lastConnect) < time.Duration(h.cfg.helper.ttl)*time.Second {
+		return nil, errDBUnavailable
+	}
+	h.lastConnect = time.Now()
+	cfg := *h.cfg
+	cfg.dbRetries = 0
+	// Helper'ов запускается несколько, и они только читают, поэтому без блокировки.
+	// Повторов нет, поэтому и ожидания, которое прерывал бы ctx.
+	s, err := openStore(context.Background(), &cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	h.s = s
+	return s, nil
+}
+
+// serve читает запросы Squid до закрытия stdin. При -concurrency>0 запросы
+// обрабатываются параллельно, ответ может прийти не по порядку.
+func (h *quotaHelper) serve(ctx context.Context, in io.Reader) error {
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		readErr <- scanner.Err()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			return err
+		case line := <-lines:
+			channel, key := parseHelperRequest(line, h.cfg.helper.concurrency > 0)
+			if channel == "" {
+				h.reply(channel, h.check(ctx, key))
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.reply(channel, h.check(ctx, key))
+			}()
+		}
+	}
+}
+
+// parseHelperRequest разбирает строку "[channel-ID] value [...]". Номер канала
+// есть, только если в external_acl_type задан concurrency, угадывать его
+// нельзя: логин тоже может быть числом.
+func parseHelperRequest(line string, concurrent bool) (channel, key string) {
+	fields := strings.Fields(line)
+	if concurrent && len(fields) > 0 {
+		channel, fields = fields[0], fields[1:]
+	}
+	if len(fields) == 0 {
+		return channel, ""
+	}
+	// Squid экранирует значения как в URL (пробел - %20)
+	key, err := url.PathUnescape(fields[0])
+	if err != nil {
+		key = fields[0]
+	}
+	return channel, key
+}
+
+func (h *quotaHelper) reply(channel, answer string) {
+	if channel != "" {
+		answer = channel + " " + answer
+	}
+	h.outMu.Lock()
+	defer h.outMu.Unlock()
+	fmt.Fprintln(h.out, answer)
+	h.out.Flush()
+}
+
+// check возвращает ответ для Squid. При ошибке БД пользователь не блокируется.
+func (h *quotaHelper) check(ctx context.Context, key string) string {
+	if key == "" || key == "-" {
+		return "ERR"
+	}
+	u, err := h.traffic(ctx, key)
+	if err != nil {
+		log.Errorf("Error getting traffic of %v:%v", key, err)
+		return `ERR message="quota is not checked"`
+	}
+	if u.over != "" {
+		log.Debugf("%v exceeded quota %v", key, u.over)
+		return fmt.Sprintf(`OK message="quota %v exceeded"`, u.over)
+	}
+	opts := h.cfg.helper
+	if opts.dailyQuota > 0 && u.day >= opts.dailyQuota<<20 {
+		log.Debugf("%v exceeded daily quota: %v of %v MB", key, u.day>>20, opts.dailyQuota)
+		return fmt.Sprintf(`OK message="daily quota %v MB exceeded"`, opts.dailyQuota)
+	}
+	if opts.monthlyQuota > 0 && u.month >= opts.monthlyQuota<<20 {
+		log.Debugf("%v exceeded monthly quota: %v of %v MB", key, u.month>>20, opts.monthlyQuota)
+		return fmt.Sprintf(`OK message="monthly quota %v MB exceeded"`, opts.monthlyQuota)
+	}
+	return "ERR"
+}
+
+// traffic берёт потребление из кэша. Устаревшее значение отдаётся сразу,
+// а обновляется в фоне, чтобы Squid не ждал запроса к БД. После смены
+// суток старое значение не годится, и запрос выполняется сразу.
+func (h *quotaHelper) traffic(ctx context.Context, key string) (userTraffic, error) {
+	now := time.Now()
+	ttl := time.Duration(h.cfg.helper.ttl) * time.Second
+	h.Lock()
+	u, ok := h.cache[key]
+	if ok && sameDay(u.fetched, now) {
+		if now.Sub(u.fetched) >= ttl && !u.refreshing {
+			u.refreshing = true
+			go h.refresh(ctx, key)
+		}
+		cached := *u
+		h.Unlock()
+		return cached, nil
+	}
+	h.Unlock()
+	return h.refresh(ctx, key)
+}
+
+func (h *quotaHelper) refresh(ctx context.Context, key string) (userTraffic, error) {
+	u, err := h.queryUsage(ctx, key)
+	h.Lock()
+	defer h.Unlock()
+	if err != nil {
+		if cached, ok := h.cache[key]; ok {
+			cached.refreshing = false
+		}
+		return u, err
+	}
+	h.cache[key] = &u
+	return u, nil
+}
+
+func sameDay(a, b time.Time) bool {
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+// queryUsage считает трафик пользователя за сегодня и за текущий месяц по scsq_quicktraffic.
+func (h *quotaHelper) queryUsage(ctx context.Context, key string) (userTraffic, error) {
+	now := time.Now()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	join := "join scsq_logins d on q.login=d.id"
+	if h.cfg.helper.by == "ip" {
+		join = "join scsq_ipaddress d on q.ipaddress=d.id"
+	}
+	u := userTraffic{fetched: now}
+	s, err := h.store()
+	if err != nil {
+		return u, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.helper.queryTimeout)
+	defer cancel()
+	if h.quotas != nil {
+		if u.over, err = h.queryQuotas(ctx, s, key, now); err != nil {
+			return u, err
+		}
+	}
+	if h.cfg.helper.dailyQuota <= 0 && h.cfg.helper.monthlyQuota <= 0 {
+		return u, nil
+	}
+	err = s.db.QueryRowContext(ctx, `select coalesce(sum(case when q.date>=? then q.sizeinbytes else 0 end),0), coalesce(sum(q.sizeinbytes),0)
+	from scsq_quicktraffic q `+join+`
+	where d.name=? and q.par=1 and q.numproxy=? and q.date>=?`,
+		dayStart.Unix(), key, h.cfg.NumPrnoxy, monthStart.Unix()).Scan(&u.day, &u.month)
+	return u, err
+}
+
+// queryQuotas возвращает имя первой квоты из -quotas, превышенной key в текущем
+// окне. Потребление считает команда quota, helper только читает scsq_quota_state.
+func (h *quotaHelper) queryQuotas(ctx context.Context, s *transport, key string, now time.Time) (string, error) {
+	login, ip := key, ""
+	if h.cfg.helper.by == "ip" {
+		login, ip = "", key
+	}
+	for _, q := range h.quotas.quotas {
+		start, _ := q.windowAt(now)
+		for _, subject := range q.subjects(login, ip) {
+			var exceeded bool
+			err := s.db.QueryRowContext(ctx, `select exceeded from scsq_quota_state
+			where quota=? and numproxy=? and subject=? and windowstart=?`,
+				q.name, h.cfg.NumPrnoxy, subject, start.Unix()).Scan(&exceeded)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			if exceeded {
+				return q.name, nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestParseHelperRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		concurrent bool
+		channel    string
+		key        string
+	}{
+		{"login", "alice", false, "", "alice"},
+		{"numeric login", "1001 10.0.0.5", false, "", "1001"},
+		{"escaped login", "DOMAIN%5Calice%20smith", false, "", `DOMAIN\alice smith`},
+		{"bad escape", "50%zz", false, "", "50%zz"},
+		{"channel", "0 alice", true, "0", "alice"},
+		{"channel and numeric login", "7 1001", true, "7", "1001"},
+		{"channel without value", "3", true, "3", ""},
+		{"empty", "", true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channel, key := parseHelperRequest(tt.line, tt.concurrent)
+			if channel != tt.channel || key != tt.key {
+				t.Errorf("got (%q, %q), want (%q, %q)", channel, key, tt.channel, tt.key)
+			}
+		})
+	}
+}
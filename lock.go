@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errLocked - файл заблокирован другим процессом.
+var errLocked = errors.New("file is locked")
+
+// instanceLock - PID-файл, захваченный через flock (LockFileEx в Windows).
+// Блокировку снимает ядро при завершении процесса, поэтому упавший запуск
+// не мешает следующему, а долгий импорт не считается зависшим по времени
+// изменения файла.
+type instanceLock struct {
+	name string
+	file *os.File
+}
+
+// lockFileName даёт отдельный PID-файл для каждого прокси, чтобы импорт
+// разных прокси мог идти параллельно: /run/go-fetch.pid -> /run/go-fetch-2.pid.
+// У прокси 1 имя прежнее, его же пишут версии без flock.
+func lockFileName(name string, numProxy int) string {
+	if numProxy == 1 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(numProxy) + ext
+}
+
+// quotaLockFileName - отдельный PID-файл команды quota: она пишет только свои
+// таблицы и blocklist'ы и не должна ждать импорта: /run/go-fetch-quota.pid.
+func quotaLockFileName(name string, numProxy int) string {
+	ext := filepath.Ext(name)
+	return lockFileName(strings.TrimSuffix(name, ext)+"-quota"+ext, numProxy)
+}
+
+func acquireLock(name string) (*instanceLock, error) {
+	// Файл не удаляется при освобождении: иначе второй процесс может
+	// захватить уже удалённый файл, а третий - создать новый.
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error open file(%v):%v", name, err)
+	}
+	if err := lockFile(file); err != nil {
+		holder := lockHolder(file)
+		file.Close()
+		if err == errLocked {
+			return nil, fmt.Errorf("go-fetch | already running: %v is locked by %v", name, holder)
+		}
+		return nil, fmt.Errorf("Error lock file(%v):%v", name, err)
+	}
+
+	// Блокировка наша. PID в файле мог записать go-fetch без flock, который
+	// ещё работает, иначе он остался от завершившегося процесса.
+	if pid := readLockPID(file); pid > 0 && pid != os.Getpid() {
+		if processAlive(pid, file) {
+			holder := lockHolder(file)
+			file.Close()
+			return nil, fmt.Errorf("go-fetch | already running: %v is held by %v without flock", name, holder)
+		}
+		log.Debugf("Replacing stale PID %v in lock %v", pid, name)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error write file(%v):%v", name, err)
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error write file(%v):%v", name, err)
+	}
+	return &instanceLock{name: name, file: file}, nil
+}
+
+// release очищает PID и снимает блокировку. Повторный вызов ничего не делает.
+func (l *instanceLock) release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.file.Truncate(0)
+	l.file.Close()
+	l.file = nil
+	log.Debugf("Lock(%v) has been released", l.name)
+}
+
+// readLockPID читает PID с начала файла, не сдвигая позицию записи.
+func readLockPID(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	return pid
+}
+
+// processAlive проверяет по /proc, что процесс pid - это go-fetch, запущенный
+// не позже, чем записан PID-файл. Иначе номер достался другому процессу,
+// и файл не должен блокировать импорт. Без /proc (не Linux) PID не проверяется.
+func processAlive(pid int, file *os.File) bool {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/cmdline", pid))
+	if err != nil || !bytes.Contains(cmdline, []byte(filepath.Base(os.Args[0]))) {
+		return false
+	}
+	started, ok := processStart(pid)
+	stat, err := file.Stat()
+	if !ok || err != nil {
+		return false
+	}
+	// время старта известно с точностью до тика
+	return !started.After(stat.ModTime().Add(time.Second))
+}
+
+// processStart - время запуска процесса: starttime из /proc/<pid>/stat
+// в тиках (USER_HZ, в Linux всегда 100) от загрузки, btime из /proc/stat.
+func processStart(pid int) (time.Time, bool) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return time.Time{}, false
+	}
+	// имя процесса в скобках может содержать пробелы
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	// после ")" идут поля с третьего, starttime - 22-е
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, false
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			boot, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return time.Unix(boot, 0).Add(time.Duration(ticks) * time.Second / 100), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// lockHolder описывает владельца блокировки для сообщения об ошибке.
+func lockHolder(file *os.File) string {
+	pid := readLockPID(file)
+	if pid <= 0 {
+		return "unknown process"
+	}
+	holder := fmt.Sprintf("PID %v", pid)
+	if cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/cmdline", pid)); err == nil {
+		holder += " (" + strings.TrimSpace(strings.Replace(string(cmdline), "\x00", " ", -1)) + ")"
+	}
+	if stat, err := file.Stat(); err == nil {
+		holder += " since " + stat.ModTime().Format(time.RFC3339)
+	}
+	return holder
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		numProxy int
+		want     string
+		quota    string
+	}{
+		// у прокси 1 имя прежнее, как у версий без flock
+		{"/run/go-fetch.pid", 1, "/run/go-fetch.pid", "/run/go-fetch-quota.pid"},
+		{"/run/go-fetch.pid", 2, "/run/go-fetch-2.pid", "/run/go-fetch-quota-2.pid"},
+		{"/var/run/go-fetch", 3, "/var/run/go-fetch-3", "/var/run/go-fetch-quota-3"},
+	}
+	for _, tt := range tests {
+		if got := lockFileName(tt.name, tt.numProxy); got != tt.want {
+			t.Errorf("lockFileName(%v, %v) = %v, want %v", tt.name, tt.numProxy, got, tt.want)
+		}
+		if got := quotaLockFileName(tt.name, tt.numProxy); got != tt.quota {
+			t.Errorf("quotaLockFileName(%v, %v) = %v, want %v", tt.name, tt.numProxy, got, tt.quota)
+		}
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	name := filepath.Join(tempDir(t), "go-fetch.pid")
+	l, err := acquireLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLock(name); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("second lock: %v", err)
+	}
+	l.release()
+	l, err = acquireLock(name)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	l.release()
+}
+
+// TestAcquireLockLegacy проверяет PID, записанный go-fetch без flock.
+func TestAcquireLockLegacy(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	// дочерний процесс - тот же тестовый бинарник, как go-fetch старой версии
+	cmd := exec.Command(os.Args[0], "-test.run=TestAcquireLockLegacyChild")
+	cmd.Env = append(os.Environ(), "GO_FETCH_TEST_SLEEP=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	name := filepath.Join(tempDir(t), "go-fetch.pid")
+	appendFile(t, name, strconv.Itoa(cmd.Process.Pid))
+	if _, err := acquireLock(name); err == nil || !strings.Contains(err.Error(), "without flock") {
+		t.Errorf("lock held by a running go-fetch without flock: %v", err)
+	}
+
+	// PID записан раньше, чем запущен процесс: номер достался другому процессу
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+	l, err := acquireLock(name)
+	if err != nil {
+		t.Fatalf("reused PID blocks the lock: %v", err)
+	}
+	l.release()
+}
+
+func TestAcquireLockLegacyChild(t *testing.T) {
+	if os.Getenv("GO_FETCH_TEST_SLEEP") != "1" {
+		t.Skip("runs as a child of TestAcquireLockLegacy")
+	}
+	time.Sleep(time.Minute)
+}
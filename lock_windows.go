@@ -0,0 +1,59 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// Блокировки Windows обязательные: запертый участок нельзя читать из других
+// процессов. Поэтому запирается байт далеко за концом файла, а PID в начале
+// файла остаётся доступен для сообщения о владельце.
+func lockRange() *syscall.Overlapped {
+	return &syscall.Overlapped{Offset: 0xFFFFFFFE, OffsetHigh: 0x7FFFFFFF}
+}
+
+func lockFileEx(file *os.File, flags uintptr) error {
+	r, _, err := procLockFileEx.Call(file.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(lockRange())))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLocked
+	}
+	return err
+}
+
+// lockFile захватывает файл без ожидания, errLocked - файл занят.
+func lockFile(file *os.File) error {
+	return lockFileEx(file, lockfileExclusiveLock|lockfileFailImmediately)
+}
+
+// waitLockFile ждёт, пока файл освободится.
+func waitLockFile(file *os.File) error {
+	return lockFileEx(file, lockfileExclusiveLock)
+}
+
+func unlockFile(file *os.File) error {
+	r, _, err := procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockRange())))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
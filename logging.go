@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Собственный лог go-fetch. Не путать с -log: это входной лог squid.
+
+type logOptions struct {
+	file   string
+	format string
+	maxMB  int
+	maxAge time.Duration
+	keep   int
+}
+
+func logFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.logOut.file, "log-file", "", "File for go-fetch's own log, stderr if empty (-log is the squid log to import)")
+	fs.StringVar(&cfg.logOut.format, "log-format", "text", "Format of go-fetch's own log: 'text' or 'json'")
+	fs.IntVar(&cfg.logOut.maxMB, "log-max-size", 100, "Rotate -log-file when it grows over this many megabytes, 0 - never")
+	fs.DurationVar(&cfg.logOut.maxAge, "log-max-age", 0, "Rotate -log-file when it is older than this, e.g. 24h, 0 - never")
+	fs.IntVar(&cfg.logOut.keep, "log-keep", 7, "Number of rotated log files to keep")
+}
+
+// runID помечает все сообщения одного запуска, чтобы его можно было найти в общем логе.
+// В daemon у каждого задания свой ID, его ставит планировщик на время задания.
+var runID atomic.Value
+
+func init() {
+	runID.Store(newRunID())
+}
+
+func currentRunID() string {
+	return runID.Load().(string)
+}
+
+// setRunID меняет ID для сообщений, у которых поле run не задано явно.
+func setRunID(id string) {
+	runID.Store(id)
+}
+
+func newRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+type runIDHook struct{}
+
+func (runIDHook) Levels() []log.Level { return log.AllLevels }
+
+func (runIDHook) Fire(e *log.Entry) error {
+	if _, ok := e.Data["run"]; !ok {
+		e.Data["run"] = currentRunID()
+	}
+	return nil
+}
+
+// setupLogging настраивает формат и вывод лога. Вызывается один раз при запуске,
+// при перечитывании настроек файл лога не меняется.
+func setupLogging(cfg *Config) error {
+	switch cfg.logOut.format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Error. log-format must be 'text' or 'json'.")
+	}
+	log.AddHook(runIDHook{})
+
+	if cfg.logOut.file == "" {
+		return nil
+	}
+	w, err := openRotatingFile(cfg.logOut)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(w)
+	reopenLog = w.reopen
+	return nil
+}
+
+// rotatingFile - файл лога с ротацией по размеру и возрасту. Старые файлы
+// получают суффикс со временем ротации, лишние удаляются.
+// rotatedSuffix - формат времени в имени ротированного файла: go-fetch.log.20060102-150405.
+const rotatedSuffix = "20060102-150405"
+
+type rotatingFile struct {
+	sync.Mutex
+	opts   logOptions
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(opts logOptions) (*rotatingFile, error) {
+	w := &rotatingFile{opts: opts}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingFile) open() error {
+	file, err := os.OpenFile(w.opts.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error open log file(%v):%v", w.opts.file, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Error open log file(%v):%v", w.opts.file, err)
+	}
+	w.file, w.size, w.opened = file, stat.Size(), time.Now()
+	return nil
+}
+
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.needRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotate log file(%v):%v\n", w.opts.file, err)
+		}
+	}
+	if w.file == nil {
+		return os.Stderr.Write(p)
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingFile) needRotate(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.opts.maxMB > 0 && w.size+int64(n) > int64(w.opts.maxMB)<<20 {
+		return true
+	}
+	return w.opts.maxAge > 0 && time.Since(w.opened) > w.opts.maxAge
+}
+
+func (w *rotatingFile) rotate() error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	rotated := w.opts.file + "." + time.Now().Format(rotatedSuffix)
+	if err := os.Rename(w.opts.file, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	w.removeOld()
+	return w.open()
+}
+
+// removeOld оставляет только opts.keep последних ротированных файлов.
+// Удаляются только файлы с суффиксом rotatedSuffix: рядом могут лежать
+// файлы logrotate (.1, .2.gz), их go-fetch не трогает.
+func (w *rotatingFile) removeOld() {
+	names, err := filepath.Glob(w.opts.file + ".*")
+	if err != nil {
+		return
+	}
+	var old []string
+	for _, name := range names {
+		if _, err := time.Parse(rotatedSuffix, name[len(w.opts.file)+1:]); err == nil {
+			old = append(old, name)
+		}
+	}
+	if len(old) <= w.opts.keep {
+		return
+	}
+	// суффикс со временем сортируется как строка
+	sort.Strings(old)
+	for _, name := range old[:len(old)-w.opts.keep] {
+		os.Remove(name)
+	}
+}
+
+// reopen переоткрывает файл после внешней ротации (logrotate), по SIGUSR1.
+func (w *rotatingFile) reopen() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	return w.open()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRemoveOld(t *testing.T) {
+	dir := tempDir(t)
+	file := filepath.Join(dir, "go-fetch.log")
+	names := []string{
+		"go-fetch.log",
+		"go-fetch.log.20240101-000000",
+		"go-fetch.log.20240102-000000",
+		"go-fetch.log.20240103-000000",
+		// файлы logrotate и чужие суффиксы
+		"go-fetch.log.1",
+		"go-fetch.log.2.gz",
+		"go-fetch.log.20240101-000000.gz",
+		"go-fetch.log.old",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &rotatingFile{opts: logOptions{file: file, keep: 1}}
+	w.removeOld()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	want := []string{
+		"go-fetch.log",
+		"go-fetch.log.1",
+		"go-fetch.log.2.gz",
+		"go-fetch.log.20240101-000000.gz",
+		"go-fetch.log.20240103-000000",
+		"go-fetch.log.old",
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
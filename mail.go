@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Рассылка отчётов по почте. Получатели задаются списком mail-to в файле
+// настроек (или флагом), записи разделяются точкой с запятой:
+//
+//	mail-to = "boss@example.com all; fin-head@example.com,cfo@example.com department=finance"
+//
+// Длинный список удобнее вынести в файл -mail-recipients, по записи на строку:
+//
+//	# кому                          о чём
+//	boss@example.com                all
+//	fin-head@example.com,cfo@example.com  department=finance
+//	alice@example.com               user=alice
+//
+// Если заданы оба, отчёты получают все. Группы и отделы берутся из файла -quotas.
+
+type mailOptions struct {
+	// period задаётся флагами только у команды mail, daemon берёт вчерашний день
+	period     period
+	to         string
+	recipients string
+	template   string
+	from       string
+	top        int
+	smtpAddr   string
+	smtpUser   string
+	smtpPass   string
+	smtpTLS    string
+	timeout    time.Duration
+}
+
+func mailFlags(fs *flag.FlagSet, cfg *Config) {
+	opts := &cfg.mail
+	fs.StringVar(&opts.to, "mail-to", "", "Report recipients and what each of them gets, '<emails> <scope>' entries separated by ';', e.g. 'boss@example.com all; anna@example.com group=accounting'")
+	fs.StringVar(&opts.recipients, "mail-recipients", "", "File with report recipients, one '<emails> <scope>' entry per line, in addition to -mail-to")
+	fs.StringVar(&opts.template, "mail-template", "", "HTML template of the report, the built-in one if empty")
+	fs.StringVar(&opts.from, "mail-from", "go-fetch@localhost", "Sender of reports")
+	fs.IntVar(&opts.top, "mail-top", 10, "Number of sites and users in a report")
+	fs.StringVar(&opts.smtpAddr, "smtp-addr", "localhost:25", "SMTP server, host:port")
+	fs.StringVar(&opts.smtpUser, "smtp-user", "", "SMTP user, no authentication if empty")
+	fs.StringVar(&opts.smtpPass, "smtp-password", "", "SMTP password")
+	fs.StringVar(&opts.smtpTLS, "smtp-tls", "auto", `STARTTLS:
+		'auto' - if the server supports it,
+		'always' - fail if the server does not support it,
+		'never' - plain connection`)
+	fs.DurationVar(&opts.timeout, "smtp-timeout", 30*time.Second, "Timeout of sending one report to the SMTP server")
+}
+
+// mailRecipient - получатели одного отчёта и его охват.
+type mailRecipient struct {
+	to      []string
+	scope   string // all, user, ip, group, department
+	subject string
+	members *members
+}
+
+func readRecipients(filename string, quotas *quotaSet) ([]mailRecipient, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error open recipients file(%v):%v", filename, err)
+	}
+	defer file.Close()
+
+	var result []mailRecipient
+	scanner := bufio.NewScanner(file)
+	for num := 1; scanner.Scan(); num++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		r, err := parseRecipient(line, quotas)
+		if err != nil {
+			return nil, fmt.Errorf("Error in recipients file(%v) line %v: %v", filename, num, err)
+		}
+		result = append(result, r)
+	}
+	return result, scanner.Err()
+}
+
+// recipientsFromList разбирает значение mail-to: записи через точку с запятой.
+func recipientsFromList(value string, quotas *quotaSet) ([]mailRecipient, error) {
+	var result []mailRecipient
+	for num, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		r, err := parseRecipient(entry, quotas)
+		if err != nil {
+			return nil, fmt.Errorf("Error in mail-to entry %v: %v", num+1, err)
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// parseRecipient разбирает запись '<emails> <scope>'.
+func parseRecipient(entry string, quotas *quotaSet) (mailRecipient, error) {
+	fields := strings.Fields(entry)
+	if len(fields) != 2 {
+		return mailRecipient{}, fmt.Errorf("expected '<emails> <scope>'")
+	}
+	r := mailRecipient{to: strings.Split(fields[0], ","), scope: fields[1]}
+	if kv := strings.SplitN(fields[1], "=", 2); len(kv) == 2 {
+		r.scope, r.subject = kv[0], kv[1]
+	}
+	switch r.scope {
+	case "all":
+	case "user", "ip":
+		if r.subject == "" {
+			return mailRecipient{}, fmt.Errorf("empty %v", r.scope)
+		}
+	case "group", "department":
+		if quotas != nil {
+			r.members = quotas.members(r.scope, r.subject)
+		}
+		if r.members == nil {
+			return mailRecipient{}, fmt.Errorf("unknown %v %v (groups and departments are read from -quotas)", r.scope, r.subject)
+		}
+	default:
+		return mailRecipient{}, fmt.Errorf("scope must be all, user=, ip=, group= or department=")
+	}
+	return r, nil
+}
+
+func (r *mailRecipient) has(login, ip string) bool {
+	switch r.scope {
+	case "user":
+		return login == r.subject
+	case "ip":
+		return ip == r.subject
+	case "group", "department":
+		return r.members.has(login, ip)
+	}
+	return true
+}
+
+func (r *mailRecipient) title() string {
+	if r.scope == "all" {
+		return "all users"
+	}
+	return r.scope + " " + r.subject
+}
+
+// trafficRow - трафик одного логина с одного адреса на один сайт.
+type trafficRow struct {
+	login, ip, site string
+	bytes           int64
+}
+
+// mailData - данные за период, общие для всех получателей.
+type mailData struct {
+	current  []trafficRow
+	previous []trafficRow
+	// denied - число запрещённых запросов по логину и адресу
+	denied []trafficRow
+}
+
+func (s *transport) readMailData(ctx context.Context, numProxy int, p period) (*mailData, error) {
+	prevFrom := p.from.Add(-p.to.Sub(p.from))
+	quick := `select coalesce(l.name,''), coalesce(ip.name,''), %v, sum(t.sizeinbytes)
+	from scsq_quicktraffic t
+	left join scsq_logins l on t.login=l.id
+	left join scsq_ipaddress ip on t.ipaddress=ip.id
+	where t.par=1 and t.numproxy=? and t.date>=? and t.date<?
+	group by t.login, t.ipaddress%v`
+	d := &mailData{}
+	var err error
+	if d.current, err = s.queryTraffic(ctx, fmt.Sprintf(quick, "t.site", ", t.site"), numProxy, p.from.Unix(), p.to.Unix()); err != nil {
+		return nil, err
+	}
+	if d.previous, err = s.queryTraffic(ctx, fmt.Sprintf(quick, "''", ""), numProxy, prevFrom.Unix(), p.from.Unix()); err != nil {
+		return nil, err
+	}
+	d.denied, err = s.queryTraffic(ctx, `select coalesce(l.name,''), coalesce(ip.name,''), '', count(*)
+	from scsq_traffic t
+	left join scsq_logins l on t.login=l.id
+	left join scsq_ipaddress ip on t.ipaddress=ip.id
+	join scsq_httpstatus h on t.httpstatus=h.id
+	where t.numproxy=? and t.date>=? and t.date<? and h.name like '%DENIED%'
+	group by t.login, t.ipaddress`, numProxy, p.from.Unix(), p.to.Unix())
+	return d, err
+}
+
+func (s *transport) queryTraffic(ctx context.Context, query string, args ...interface{}) ([]trafficRow, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []trafficRow
+	for rows.Next() {
+		var r trafficRow
+		if err := rows.Scan(&r.login, &r.ip, &r.site, &r.bytes); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// mailReport - данные шаблона письма.
+type mailReport struct {
+	Title     string
+	Proxy     int
+	From      time.Time
+	To        time.Time
+	Total     int64
+	PrevTotal int64
+	// Trend - изменение к предыдущему такому же периоду в процентах
+	Trend    float64
+	HasTrend bool
+	Denied   int64
+	TopSites []reportRow
+	// TopUsers не заполняется для отчёта по одному пользователю
+	TopUsers []reportRow
+}
+
+func buildMailReport(r *mailRecipient, d *mailData, p period, numProxy, top int) *mailReport {
+	rep := &mailReport{Title: r.title(), Proxy: numProxy, From: p.from, To: p.to}
+	sites := map[string]int64{}
+	users := map[string]int64{}
+	for _, row := range d.current {
+		if !r.has(row.login, row.ip) {
+			continue
+		}
+		rep.Total += row.bytes
+		sites[row.site] += row.bytes
+		user := row.login
+		if user == "" || user == "-" {
+			user = row.ip
+		}
+		users[user] += row.bytes
+	}
+	for _, row := range d.previous {
+		if r.has(row.login, row.ip) {
+			rep.PrevTotal += row.bytes
+		}
+	}
+	for _, row := range d.denied {
+		if r.has(row.login, row.ip) {
+			rep.Denied += row.bytes
+		}
+	}
+	if rep.PrevTotal > 0 {
+		rep.HasTrend = true
+		rep.Trend = float64(rep.Total-rep.PrevTotal) * 100 / float64(rep.PrevTotal)
+	}
+	rep.TopSites = topRows(sites, rep.Total, top)
+	if r.scope != "user" && r.scope != "ip" {
+		rep.TopUsers = topRows(users, rep.Total, top)
+	}
+	return rep
+}
+
+func topRows(values map[string]int64, total int64, top int) []reportRow {
+	rows := make([]reportRow, 0, len(values))
+	for name, bytes := range values {
+		rows = append(rows, reportRow{Name: name, Bytes: bytes})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Bytes != rows[j].Bytes {
+			return rows[i].Bytes > rows[j].Bytes
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	if top > 0 && len(rows) > top {
+		rows = rows[:top]
+	}
+	for i := range rows {
+		rows[i].Rank = i + 1
+		if total > 0 {
+			rows[i].Percent = float64(rows[i].Bytes) * 100 / float64(total)
+		}
+	}
+	return rows
+}
+
+const defaultMailTemplate = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Traffic of {{.Title}}</title></head>
+<body style="font-family: sans-serif">
+<h2>Traffic of {{.Title}}</h2>
+<p>Proxy {{.Proxy}}, {{.From.Format "2006-01-02 15:04"}} - {{.To.Format "2006-01-02 15:04"}}</p>
+<p>Total: <b>{{bytes .Total}}</b>{{if .HasTrend}}, {{printf "%+.1f" .Trend}}% against the previous period ({{bytes .PrevTotal}}){{end}}<br>
+Denied requests: <b>{{.Denied}}</b></p>
+{{if .TopSites}}<h3>Top sites</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>#</th><th>Site</th><th>Traffic</th><th>%</th></tr>
+{{range .TopSites}}<tr><td>{{.Rank}}</td><td>{{.Name}}</td><td align="right">{{bytes .Bytes}}</td><td align="right">{{printf "%.1f" .Percent}}</td></tr>
+{{end}}</table>{{end}}
+{{if .TopUsers}}<h3>Top users</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>#</th><th>User</th><th>Traffic</th><th>%</th></tr>
+{{range .TopUsers}}<tr><td>{{.Rank}}</td><td>{{.Name}}</td><td align="right">{{bytes .Bytes}}</td><td align="right">{{printf "%.1f" .Percent}}</td></tr>
+{{end}}</table>{{end}}
+</body></html>
+`
+
+func loadMailTemplate(filename string) (*template.Template, error) {
+	t := template.New("report").Funcs(template.FuncMap{
+		"bytes": func(n int64) string { return formatBytes(float64(n)) },
+	})
+	if filename == "" {
+		return t.Parse(defaultMailTemplate)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error read mail template(%v):%v", filename, err)
+	}
+	return t.Parse(string(data))
+}
+
+// buildMessage собирает письмо в формате RFC 5322 с HTML в quoted-printable.
+func buildMessage(from string, to []string, subject string, html []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %v\r\n", from)
+	fmt.Fprintf(&buf, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write(html)
+	qp.Close()
+	return buf.Bytes()
+}
+
+// sendMail отправляет письмо, при возможности через STARTTLS.
+// PLAIN-авторизация без TLS net/smtp разрешает только для localhost.
+func sendMail(opts *mailOptions, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(opts.smtpAddr)
+	if err != nil {
+		return fmt.Errorf("Error. Bad smtp-addr %v:%v", opts.smtpAddr, err)
+	}
+	conn, err := net.DialTimeout("tcp", opts.smtpAddr, opts.timeout)
+	if err != nil {
+		return fmt.Errorf("Error connecting to SMTP server(%v):%v", opts.smtpAddr, err)
+	}
+	// без срока зависший сервер остановил бы daemon
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if opts.smtpTLS != "never" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return fmt.Errorf("Error STARTTLS:%v", err)
+			}
+		} else if opts.smtpTLS == "always" {
+			return fmt.Errorf("Error. SMTP server %v does not support STARTTLS", opts.smtpAddr)
+		}
+	}
+	if opts.smtpUser != "" {
+		if err := c.Auth(smtp.PlainAuth("", opts.smtpUser, opts.smtpPass, host)); err != nil {
+			return fmt.Errorf("Error SMTP auth:%v", err)
+		}
+	}
+	if err := c.Mail(opts.from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return fmt.Errorf("Error recipient %v:%v", addr, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func runMail(ctx context.Context, cfg *Config) error {
+	opts := &cfg.mail
+	if opts.to == "" && opts.recipients == "" {
+		return fmt.Errorf("Error. -mail-to or -mail-recipients must be set")
+	}
+	if opts.smtpTLS != "auto" && opts.smtpTLS != "always" && opts.smtpTLS != "never" {
+		return fmt.Errorf("Error. smtp-tls must be 'auto', 'always' or 'never'")
+	}
+	if err := cfg.mail.period.parse(); err != nil {
+		return err
+	}
+	var quotas *quotaSet
+	if cfg.quota.file != "" {
+		var err error
+		if quotas, err = readQuotas(cfg.quota.file); err != nil {
+			return err
+		}
+	}
+	recipients, err := recipientsFromList(opts.to, quotas)
+	if err != nil {
+		return err
+	}
+	if opts.recipients != "" {
+		fromFile, err := readRecipients(opts.recipients, quotas)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, fromFile...)
+	}
+	tmpl, err := loadMailTemplate(opts.template)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	data, err := store.readMailData(ctx, cfg.NumPrnoxy, cfg.mail.period)
+	if err != nil {
+		return fmt.Errorf("Error reading traffic:%v", err)
+	}
+
+	failed := 0
+	for i := range recipients {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		r := &recipients[i]
+		rep := buildMailReport(r, data, cfg.mail.period, cfg.NumPrnoxy, opts.top)
+		var html bytes.Buffer
+		if err := tmpl.Execute(&html, rep); err != nil {
+			return fmt.Errorf("Error in mail template:%v", err)
+		}
+		subject := fmt.Sprintf("Traffic of %v for %v", rep.Title, rep.From.Format("2006-01-02"))
+		if err := sendMail(opts, r.to, buildMessage(opts.from, r.to, subject, html.Bytes())); err != nil {
+			log.Errorf("Error sending report on %v to %v:%v", rep.Title, strings.Join(r.to, ","), err)
+			failed++
+			continue
+		}
+		log.Infof("Report on %v sent to %v", rep.Title, strings.Join(r.to, ","))
+	}
+	if failed > 0 {
+		return fmt.Errorf("Error. %v of %v reports were not sent", failed, len(recipients))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		to      []string
+		subject string
+		html    string
+	}{
+		{"ascii", []string{"admin@example.com"}, "Traffic report", "<p>ok</p>"},
+		{"utf-8", []string{"a@example.com", "b@example.com"}, "Отчёт о трафике", "<p>Трафик: 10 ГБ</p>"},
+		{"long line", []string{"a@example.com"}, "Report", "<table>" + strings.Repeat("<td>=1</td>", 100) + "</table>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := buildMessage("go-fetch@example.com", tt.to, tt.subject, []byte(tt.html))
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := msg.Header
+			if got := h.Get("From"); got != "go-fetch@example.com" {
+				t.Errorf("From %q", got)
+			}
+			to, err := h.AddressList("To")
+			if err != nil || len(to) != len(tt.to) {
+				t.Fatalf("To %v:%v", to, err)
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(h.Get("Subject"))
+			if err != nil || subject != tt.subject {
+				t.Errorf("Subject %q:%v, want %q", subject, err, tt.subject)
+			}
+			if _, err := h.Date(); err != nil {
+				t.Errorf("Date:%v", err)
+			}
+			if got := h.Get("Content-Type"); got != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type %q", got)
+			}
+			for _, line := range strings.Split(string(raw), "\r\n") {
+				if len(line) > 998 {
+					t.Fatalf("line of %v bytes", len(line))
+				}
+			}
+			body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.html {
+				t.Errorf("body %q, want %q", body, tt.html)
+			}
+		})
+	}
+}
+
+func TestRecipientsFromList(t *testing.T) {
+	quotas := &quotaSet{groups: map[string]*members{"accounting": {logins: map[string]bool{"alice": true}}}}
+	got, err := recipientsFromList("boss@example.com all; a@example.com,b@example.com group=accounting;", quotas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %v recipients, want 2", len(got))
+	}
+	if got[0].scope != "all" || !reflect.DeepEqual(got[0].to, []string{"boss@example.com"}) {
+		t.Errorf("got %+v", got[0])
+	}
+	if got[1].scope != "group" || got[1].subject != "accounting" || !got[1].has("alice", "") ||
+		!reflect.DeepEqual(got[1].to, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("got %+v", got[1])
+	}
+
+	for value, want := range map[string]string{
+		"boss@example.com":                       "entry 1: expected '<emails> <scope>'",
+		"boss@example.com all; x@example.com me": "entry 2: scope must be",
+		"x@example.com group=sales":              "entry 1: unknown group sales",
+	} {
+		if _, err := recipientsFromList(value, quotas); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", value, err, want)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"database/sql"
-	"flag"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -29,24 +30,72 @@ type Config struct {
 	lastDate    string
 	LogLevel    string
 	NumPrnoxy   int
-	maxLen      int
 	numLines    int
 	startTime   time.Time
 	endTime     time.Time
 	lineAdded   int
 	lineRead    int
+	// lineParsed - строки, успешно разобранные
+	lineParsed int
+	// lineRejected - строки, не прошедшие разбор или не принятые БД
+	lineRejected int
+	// lineDuplicate - строки, пропущенные как уже загруженные
+	lineDuplicate int
+
+	dbRetries      int
+	dbRetryDelay   time.Duration
+	dryRun         bool
+	quarantineType string
+	quarantineFile string
+	dedupType      string
+	dedupSize      int
+	follow         bool
+	pollInterval   time.Duration
+	checkpointFile string
+	streamType     string
+	streamAddr     string
+	streamTopic    string
+	streamKey      string
+	streamFormat   string
+	streamBuffer   int
+	httpAddr       string
+	metricsFile    string
+	readyMaxLag    int64
+
+	purge    purgeOptions
+	export   exportOptions
+	rebuild  period
+	verify   verifyOptions
+	daemon   daemonOptions
+	helper   helperOptions
+	quota    quotaOptions
+	report   reportOptions
+	mail     mailOptions
+	api      apiOptions
+	status   statusOptions
+	logOut   logOptions
+	progress progressOptions
 }
 
 type transport struct {
-	db       *sql.DB
-	lines    []lineOfLogType
-	exitChan chan os.Signal
+	db    *sql.DB
+	lines []lineOfLogType
+	pub   publisher
+	quar  quarantine
+	retry retryPolicy
+	dedup deduper
+	run   *runRecord
+	// restream - импорт продолжен с checkpoint'а: строки старше lastDate уже
+	// в БД, но их получение потоком могло быть не подтверждено
+	restream bool
+	// lock - PID-файл, захваченный этим процессом
+	lock *instanceLock
 	sync.RWMutex
 }
 
 type lineOfLogType struct {
-	date string
-	// dealy       string
+	date        string
+	elapsed     string
 	ipaddress   string
 	httpstatus  string
 	sizeInBytes string
@@ -54,231 +103,333 @@ type lineOfLogType struct {
 	siteName    string
 	login       string
 	mime        string
+	// исходная строка и её положение в файле, нужны для карантина
+	raw    string
+	source string
+	offset int64
 }
 
 var (
 	config Config
 	// line   lineOfLogType
-)
-
-func init() {
-
-	flag.StringVar(&config.typedb, "typedb", "mysql", `Type of DB: 
-		'mysql' - MySQL, 
-		'postgres' - PostgreSQL`)
-	flag.StringVar(&config.fileLog, "log", "/var/log/squid/access.log", "Squid log file")
-	flag.StringVar(&config.userDB, "u", "root", "User of DB")
-	flag.StringVar(&config.passDB, "p", "", "Password of DB")
-	flag.StringVar(&config.hostDB, "h", "localhost", "host of DB")
-	flag.StringVar(&config.nameDB, "n", "squidreport2", "name of DB")
-	flag.IntVar(&config.numLines, "nl", 1000, "Number of lines")
-	flag.IntVar(&config.NumPrnoxy, "np", 1, "Number of proxy")
-	flag.StringVar(&config.LogLevel, "loglevel", "debug", "Level log:")
-	flag.StringVar(&config.PIDFileName, "pid", "/run/go-fetch.pid", "Patch to PID File")
-	// flag.IntVar(&config.ttl, "ttl", 300, "Defines the time after which data from the database will be updated in seconds")
-	flag.Parse()
-
-	lvl, err := log.ParseLevel(config.LogLevel)
-	if err != nil {
-		log.Errorf("Error in determining the level of logs (%v). Installed by default = Info", config.LogLevel)
-		lvl, _ = log.ParseLevel("info")
-	}
-	log.SetLevel(lvl)
 
-	log.Debugf("Config: %#v",
-		config)
-
-	if config.typedb != "mysql" && config.typedb != "postgres" {
-		log.Fatal("Error. typedb must be 'mysql' or 'postgres'.")
-	}
-	if config.userDB == "" {
-		log.Fatal("Error. Username must be specified.")
-	}
-}
+	errNotSquidLog  = errors.New("Error, line is NOT squid-log")
+	errTooFewFields = errors.New("Error, too few fields in line")
+	errBadTimestamp = errors.New("Error, timestamp is not a number")
+)
 
 func main() {
 	config.startTime = time.Now()
-	log.Info("go-fetch | Init started")
 
-	if err := CheckPIDFile(config.PIDFileName); err != nil {
+	cmd, err := parseCommandLine(os.Args[1:], &config)
+	if err != nil {
 		log.Fatal(err)
 	}
-	if err := writePID(config.PIDFileName); err != nil {
+	if err := setupAndValidate(&config); err != nil {
 		log.Fatal(err)
 	}
-
-	// fmt.Printf("\n%v - Start All Job.\n", config.startTime.Format("2006-01-02 15:04:05.000"))
-
-	// dsn := "user:password@(host_bd)/dbname"
-	// db, err := sql.Open("mysql", dsn)
-	config.SQLAddr = fmt.Sprintf("%v:%v@(%v)/%v", config.userDB, config.passDB, config.hostDB, config.nameDB)
-	db, err := newDB(config.typedb, config.SQLAddr)
-	if err != nil {
-		log.Fatalf("%v", err)
+	if err := setupLogging(&config); err != nil {
+		log.Fatal(err)
 	}
-	defer db.Close()
+	// Настройки целиком не выводятся: в них пароли БД и SMTP и токены API
+	log.Debugf("Config: DB %v %v@%v/%v, proxy %v, log %v", config.typedb, config.userDB, config.hostDB, config.nameDB,
+		config.NumPrnoxy, config.fileLog)
 
-	store := newStore(db)
+	log.Infof("go-fetch | %v started", cmd.name)
+	if err := cmd.run(shutdownContext(), &config); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	go store.Exit()
+func runImport(ctx context.Context, cfg *Config) (err error) {
+	if cfg.dryRun {
+		return dryRun(ctx, cfg)
+	}
 
-	config.lastDate = store.readLastDate(config.NumPrnoxy)
+	store, err := openStore(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
 
-	config.lastDay = store.readLastDay(config.NumPrnoxy)
-	lastDate, _ := strconv.ParseInt(config.lastDay, 10, 64)
-	log.Debugf("config.lastDate:%v, lastDate::%v, config.NumPrnoxy:%v", config.lastDate, time.Unix(lastDate, 0), config.NumPrnoxy)
+	// fmt.Printf("\n%v - Start All Job.\n", config.startTime.Format("2006-01-02 15:04:05.000"))
 
-	if err := store.prepareDB(config.lastDay, config.NumPrnoxy); err != nil {
-		log.Fatal("Error delete old data", err)
+	store.pub, err = newPublisher(cfg)
+	if err != nil {
+		return err
 	}
 
-	// fmt.Printf("config.lastDate:%v, config.lastDay:%v\n", config.lastDate, config.lastDay)
+	store.quar, err = newQuarantine(cfg, store.db)
+	if err != nil {
+		return err
+	}
 
-	file, err := os.Open(config.fileLog)
+	store.dedup, err = newDeduper(cfg, store)
 	if err != nil {
-		log.Fatal("Error opening squid log file", err)
+		return err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	command := "import"
+	if cfg.follow {
+		command = "follow"
+	}
+	store.startRun(cfg, command)
+	defer func() { store.finishRun(err) }()
 
-	err2 := store.squidLog2DBbyLine(scanner, &config)
-	if err2 != nil {
-		log.Fatalf("%v", err)
+	if _, err := serveHTTP(cfg, store); err != nil {
+		return err
 	}
+	defer writeMetricsFile(cfg)
 
-	numStart := 0
+	handleControlSignals(cfg.follow)
+	setupWatchdog(cfg)
 
-	err3 := store.writeToDBTech(&config, numStart, config.lineAdded)
-	if err3 != nil {
-		log.Fatalf("%v", err)
-		os.Exit(1)
-	}
+	cfg.lastDate = store.readLastDate(cfg.NumPrnoxy)
+
+	cfg.lastDay = store.readLastDay(cfg.NumPrnoxy)
+	lastDate, _ := strconv.ParseInt(cfg.lastDay, 10, 64)
+	log.Debugf("config.lastDate:%v, lastDate::%v, config.NumPrnoxy:%v", cfg.lastDate, time.Unix(lastDate, 0), cfg.NumPrnoxy)
 
-	if err := os.Remove(config.PIDFileName); err != nil {
-		log.Errorf("Error remove file(%v):%v", config.PIDFileName, err)
+	t := time.Now()
+	if err := store.prepareDB(cfg.lastDay, cfg.NumPrnoxy); err != nil {
+		return fmt.Errorf("Error delete old data:%v", err)
 	}
-	fmt.Printf("\n")
+	store.run.since(phasePrepare, t)
 
-}
+	// fmt.Printf("config.lastDate:%v, config.lastDay:%v\n", config.lastDate, config.lastDay)
 
-func CheckPIDFile(filename string) error {
-	// Просмотреть инфу о файле
-	if stat, err := os.Stat(filename); err != nil {
-		// Если его нет - запуститься
-		if os.IsNotExist(err) {
-			return nil
+	var offset int64
+	if cfg.checkpointFile != "" {
+		cp, err := readCheckpoint(cfg.checkpointFile)
+		if err != nil {
+			return err
 		}
+		offset = resumeOffset(cp, cfg.fileLog)
+		log.Debugf("Resume %v from offset %v", cfg.fileLog, offset)
+	}
+	if store.run != nil {
+		store.run.offsetStart, store.run.offsetEnd = offset, offset
+	}
+	store.restream = offset > 0 && store.pub != nil
 
-		// Если время более 15 минут - удалить этот файл и запустить прогу
-	} else if time.Since(stat.ModTime()) > 15*time.Minute {
+	if err := setupProgress(cfg.progress, offset); err != nil {
+		return err
+	}
+	defer reporter.finish()
 
-		if err := os.Remove(filename); err != nil {
-			log.Errorf("Error remove file(%v):%v", filename, err)
-		}
-		if err := writePID(filename); err != nil {
-			return err
-		}
+	reader, err := openLogReader(cfg.fileLog, offset, cfg.follow)
+	if err != nil {
+		return fmt.Errorf("Error opening squid log file:%v", err)
+	}
+	defer reader.Close()
 
-		return nil
-		// Если он есть и время его изменения менее 15 минут - не запускться.
+	if err := sdNotify("READY=1\nSTATUS=Importing " + cfg.fileLog); err != nil {
+		log.Warningf("Error sd_notify:%v", err)
+	}
 
+	// squidLog2DBbyLine сам переносит данные из scsq_temptraffic и пересчитывает
+	// scsq_quicktraffic, повторный writeToDBTech не нужен.
+	if err := store.squidLog2DBbyLine(ctx, reader, cfg); err != nil {
+		return err
 	}
-	return fmt.Errorf("go-fetch | already running")
+	return nil
 }
 
-func writePID(filename string) error {
-	file, err := os.Create(filename)
+func runReplay(ctx context.Context, cfg *Config) error {
+	store, err := openStore(ctx, cfg, true)
 	if err != nil {
-		return fmt.Errorf("Error open file(%v):%v", filename, err)
+		return err
 	}
-	defer file.Close()
-	_, err2 := file.Write([]byte(fmt.Sprint(os.Getpid())))
-	if err2 != nil {
-		return fmt.Errorf("Error write file=(%v), data=(%v):%v", filename, os.Getpid(), err)
+	defer store.Close()
+
+	store.quar, err = newQuarantine(cfg, store.db)
+	if err != nil {
+		return err
 	}
-	return nil
+
+	// Карантин загружается одним пакетом, поэтому сигнал остановки не проверяется:
+	// пакет дописывается до конца.
+	return store.replay(cfg)
 }
 
 // #clear last date in table with data.
 func (s *transport) prepareDB(lastDay string, numProxy int) error {
-	_, err := s.db.Exec("delete from scsq_quicktraffic where date>? and numproxy=?", lastDay, numProxy)
-	if err != nil {
+	if err := s.clearQuickTraffic(lastDay, numProxy); err != nil {
 		return err
 	}
 
-	// #clear temptable to be sure, that table have no strange data before import.
-	_, err2 := s.db.Exec("delete from scsq_temptraffic where numproxy=?", numProxy)
-	if err2 != nil {
-		return err
-	}
+	return s.clearTempTraffic(numProxy)
+}
 
-	return nil
+func (s *transport) clearQuickTraffic(lastDay string, numProxy int) error {
+	return s.exec("clearing scsq_quicktraffic", "delete from scsq_quicktraffic where date>? and numproxy=?", lastDay, numProxy)
 }
 
-func (s *transport) squidLog2DBbyLine(scanner *bufio.Scanner, cfg *Config) error {
+func (s *transport) clearTempTraffic(numProxy int) error {
+	// #clear temptable to be sure, that table have no strange data before import.
+	return s.exec("clearing scsq_temptraffic", "delete from scsq_temptraffic where numproxy=?", numProxy)
+}
+
+// squidLog2DBbyLine читает лог до конца (в режиме follow - до отмены ctx).
+// При отмене текущий пакет дописывается, данные переносятся из scsq_temptraffic
+// и сохраняется checkpoint, после чего возвращается errInterrupted.
+func (s *transport) squidLog2DBbyLine(ctx context.Context, r *logReader, cfg *Config) error {
 	var arrayOfLineOut []lineOfLogType
-	for scanner.Scan() { // Проходим по всему файлу до конца
+	// состояние на момент последней фиксации в режиме follow
+	committedAdded, committedOffset := cfg.lineAdded, r.offset
+	for ctx.Err() == nil { // Проходим по всему файлу до конца
+		heartbeat.alive()
+		// в daemon SIGHUP обрабатывает планировщик, а не задание импорта
+		if cfg.follow {
+			select {
+			case <-reloadRequests:
+				s.reloadConfig(cfg)
+			default:
+			}
+		}
+		line, err := r.readLine() // получем текст из линии
+		if err == errNoData {
+			// Новых строк пока нет - фиксируем накопленное и ждём
+			if _, err := s.writeArrayToDB(arrayOfLineOut, cfg); errors.Is(err, errDBUnavailable) {
+				return err
+			} else if err != nil {
+				log.Errorf("Error in s.writeArrayToDB:%v", err)
+			}
+			arrayOfLineOut = nil
+			// Без новых строк пересчитывать scsq_quicktraffic незачем,
+			// достаточно сдвинуть checkpoint за старые и отбракованные строки.
+			var err error
+			switch {
+			case cfg.lineAdded != committedAdded:
+				err = s.commitFollow(r, cfg)
+			case r.offset != committedOffset:
+				err = s.commitCheckpoint(r, cfg)
+			}
+			if errors.Is(err, errDBUnavailable) {
+				return err
+			} else if err != nil {
+				metrics.setError(err)
+				log.Errorf("Error in s.commitFollow:%v", err)
+			} else {
+				committedAdded, committedOffset = cfg.lineAdded, r.offset
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(cfg.pollInterval):
+			}
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("%v", err)
+			return err
+		}
 		cfg.lineRead = cfg.lineRead + 1
-		line := scanner.Text() // получем текст из линии
+		metrics.readLine(r.name, r.offset)
 		if line == "" {
 			continue
 		}
-		line = replaceQuotes(line)
 		ProgressLine(cfg, "", 0)
 
-		lineOut, err := parseLineToStruct(line)
+		lineOut, err := parseLineToStruct(replaceQuotes(line))
+		lineOut.raw = line
+		lineOut.source = r.name
+		lineOut.offset = r.lineStart
 		if err != nil {
-			log.Errorf("(%v) %v\n", lineOut, err)
+			s.reject([]lineOfLogType{lineOut}, err.Error(), cfg)
 			continue
 		}
+		cfg.lineParsed++
 
 		if cfg.lastDate > lineOut.date {
 			log.Tracef("line(%v) too old\r", lineOut)
+			if s.restream {
+				if err := s.publishLine(lineOut, cfg); err != nil {
+					log.Errorf("Error publish(%v):%v", lineOut.raw, err)
+				}
+			}
 			continue
 		}
 		arrayOfLineOut = append(arrayOfLineOut, lineOut)
 		if cfg.lineRead%cfg.numLines == 0 {
-			if err := s.writeArrayToDB(arrayOfLineOut, cfg); err != nil {
+			// Неудачные строки writeArrayToDB уже отправил в карантин,
+			// поэтому массив очищаем в любом случае, иначе он уйдёт повторно.
+			if _, err := s.writeArrayToDB(arrayOfLineOut, cfg); errors.Is(err, errDBUnavailable) {
+				return err
+			} else if err != nil {
 				log.Warningf("Error in s.writeArrayToDB:%v", err)
-				continue
 			}
 			arrayOfLineOut = nil
 		}
 
 	}
-	if err := s.writeArrayToDB(arrayOfLineOut, cfg); err != nil {
+	if ctx.Err() != nil {
+		sdNotify("STOPPING=1\nSTATUS=Finishing the current batch")
+	}
+	// При недоступной БД checkpoint не сдвигается: следующий запуск
+	// перечитает строки с последней зафиксированной позиции.
+	if _, err := s.writeArrayToDB(arrayOfLineOut, cfg); errors.Is(err, errDBUnavailable) {
+		return err
+	} else if err != nil {
 		log.Errorf("Error in s.writeArrayToDB:%v", err)
 	}
-	if err := s.writeToDBTech(cfg, cfg.lineRead, cfg.lineAdded); err != nil {
-		log.Errorf("Error in s.writeToDBTech:%v", err)
+	if cfg.follow {
+		if err := s.commitFollow(r, cfg); err != nil {
+			log.Errorf("Error in s.commitFollow:%v", err)
+			return err
+		}
+	} else {
+		if err := s.writeToDBTech(cfg, cfg.lineRead, cfg.lineAdded); err != nil {
+			log.Errorf("Error in s.writeToDBTech:%v", err)
+			return err
+		}
+		if err := s.commitCheckpoint(r, cfg); err != nil {
+			log.Errorf("Error in s.commitCheckpoint:%v", err)
+		}
+	}
+	if ctx.Err() != nil {
+		return errInterrupted
 	}
+	return nil
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Errorf("%v", err)
+// commitFollow переносит накопленное в режиме follow из временной таблицы
+// и пересчитывает scsq_quicktraffic за последний день.
+func (s *transport) commitFollow(r *logReader, cfg *Config) error {
+	cfg.lastDay = s.readLastDay(cfg.NumPrnoxy)
+	if err := s.writeToDBTech(cfg, cfg.lineRead, cfg.lineAdded); err != nil {
+		return err
+	}
+	if err := s.commitCheckpoint(r, cfg); err != nil {
 		return err
 	}
+	s.updateRun("running", "")
+	writeMetricsFile(cfg)
 	return nil
 }
 
-func ProgressLine(cfg *Config, text string, since time.Duration) {
-	var str string
-	if text == "" && since == 0 {
-		since := int(time.Since(cfg.startTime).Seconds())
-		if since < 1 {
-			since = 1
+// commitCheckpoint сохраняет позицию в логе только после того,
+// как данные записаны в БД и потребители потока подтвердили получение.
+func (s *transport) commitCheckpoint(r *logReader, cfg *Config) error {
+	if s.pub != nil {
+		if err := s.pub.Flush(); err != nil {
+			return err
 		}
-		lineInSec := cfg.lineAdded / since
-		str = fmt.Sprintf("\r%v Lines read/added:%v/%v. %v line/sec.", time.Now().Format("2006/01/02 15:04:05"), cfg.lineRead, cfg.lineAdded, lineInSec)
-	} else {
-		str = fmt.Sprintf("\r%v Lines read/added:%v/%v. %v:%.8v", time.Now().Format("2006/01/02 15:04:05"), cfg.lineRead, cfg.lineAdded, text, since)
 	}
-	if len(str) > cfg.maxLen {
-		cfg.maxLen = len(str)
-	} else {
-		str = str + strings.Repeat(" ", cfg.maxLen-len(str))
+	metrics.commit(r.name, r.offset)
+	if s.run != nil {
+		s.run.offsetEnd = r.offset
 	}
-	fmt.Print(str)
+	if cfg.checkpointFile == "" {
+		return nil
+	}
+	return writeCheckpoint(cfg.checkpointFile, checkpoint{
+		File:   r.name,
+		Offset: r.offset,
+		Head:   r.head(),
+	})
 }
 
 func replaceQuotes(lineOld string) string {
@@ -291,9 +442,16 @@ func parseLineToStruct(line string) (lineOfLogType, error) {
 	var lineOut lineOfLogType
 	valueArray := strings.Fields(line) // разбиваем на поля через пробел
 	if len(valueArray) == 0 {          // проверяем длину строки, чтобы убедиться что строка нормально распарсилась\её формат
-		return lineOut, fmt.Errorf("Error, line is NOT squid-log") // если это не так то следующая линия
+		return lineOut, errNotSquidLog // если это не так то следующая линия
+	}
+	if len(valueArray) < 10 {
+		return lineOut, errTooFewFields
+	}
+	if _, err := strconv.ParseFloat(valueArray[0], 64); err != nil {
+		return lineOut, errBadTimestamp
 	}
 	lineOut.date = valueArray[0]
+	lineOut.elapsed = valueArray[1]
 	lineOut.ipaddress = valueArray[2]
 	lineOut.httpstatus = valueArray[3]
 	lineOut.sizeInBytes = valueArray[4]
@@ -304,22 +462,100 @@ func parseLineToStruct(line string) (lineOfLogType, error) {
 	return lineOut, nil
 }
 
-func (s *transport) writeArrayToDB(arrayOfLineOut []lineOfLogType, cfg *Config) error {
-	stmt, err := s.db.Prepare("INSERT INTO scsq_temptraffic (date,ipaddress,httpstatus,sizeinbytes,site,login,method,mime, numproxy) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
+// writeArrayToDB пишет строки в scsq_temptraffic. done - сколько строк с начала
+// массива обработано: записано, пропущено как дубликат или отправлено в карантин.
+// Остальные строки при ошибке не тронуты, их можно записать повторно.
+func (s *transport) writeArrayToDB(arrayOfLineOut []lineOfLogType, cfg *Config) (done int, err error) {
+	if len(arrayOfLineOut) == 0 {
+		return 0, nil
+	}
+	t := time.Now()
+	defer func() {
+		s.run.since(phaseInsert, t)
+		metrics.observeBatch(time.Since(t), err)
+	}()
+	var stmt *sql.Stmt
+	err = s.retry.do("prepare insert into scsq_temptraffic", func() (err error) {
+		stmt, err = s.db.Prepare("INSERT INTO scsq_temptraffic (date,ipaddress,httpstatus,sizeinbytes,site,login,method,mime, numproxy) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)")
 		return err
+	})
+	if errors.Is(err, errDBUnavailable) {
+		return 0, err
+	}
+	if err != nil {
+		s.reject(arrayOfLineOut, err.Error(), cfg)
+		return len(arrayOfLineOut), err
 	}
 	defer stmt.Close()
-	for _, lineOut := range arrayOfLineOut {
+	// Отпечатки всего пакета проверяются одним запросом. Если проверить их нельзя,
+	// импорт останавливается без checkpoint'а, как при недоступной БД:
+	// строки будут прочитаны заново при следующем запуске.
+	var hashes []string
+	var dups []bool
+	if s.dedup != nil {
+		hashes = make([]string, len(arrayOfLineOut))
+		for i, v := range arrayOfLineOut {
+			hashes[i] = lineHash(v, cfg.NumPrnoxy)
+		}
+		if dups, err = s.dedup.seen(hashes); err != nil {
+			if !errors.Is(err, errDBUnavailable) {
+				err = fmt.Errorf("%w: checking duplicates:%v", errDBUnavailable, err)
+			}
+			return 0, err
+		}
+	}
+	// одинаковые строки внутри пакета
+	inBatch := make(map[string]bool)
+	// Строки пишутся по одной, поэтому ошибка относится только к текущей строке:
+	// она уходит в карантин, а остальные строки пакета продолжают записываться.
+	var failed int
+	var lastErr error
+	for i, lineOut := range arrayOfLineOut {
 		v := lineOut
-		_, err2 := stmt.Exec(v.date, v.ipaddress, v.httpstatus, v.sizeInBytes, v.siteName, v.login, v.method, v.mime, cfg.NumPrnoxy)
+		var hash string
+		if s.dedup != nil {
+			hash = hashes[i]
+			if dups[i] || inBatch[hash] {
+				log.Tracef("line(%v) is a duplicate", v.raw)
+				cfg.lineDuplicate++
+				metrics.duplicate()
+				continue
+			}
+		}
+		// Вставка не повторяется: после обрыва соединения строка могла уже
+		// оказаться в scsq_temptraffic. Импорт останавливается без checkpoint'а,
+		// следующий запуск очистит scsq_temptraffic и перечитает строки.
+		err2 := s.retry.once("insert into scsq_temptraffic", func() error {
+			_, err := stmt.Exec(v.date, v.ipaddress, v.httpstatus, v.sizeInBytes, v.siteName, v.login, v.method, v.mime, cfg.NumPrnoxy)
+			return err
+		})
+		if errors.Is(err2, errDBUnavailable) {
+			// БД недоступна - строка не плохая, её нельзя отправлять в карантин
+			return i, err2
+		}
 		if err2 != nil {
-			return fmt.Errorf("Error source(%v) at %v line:%v", v, cfg.lineAdded, err2)
+			log.Debugf("Error source(%v) at %v line:%v", v.raw, cfg.lineAdded, err2)
+			s.reject(arrayOfLineOut[i:i+1], err2.Error(), cfg)
+			failed++
+			lastErr = err2
+			continue
+		}
+		if s.dedup != nil {
+			s.dedup.add(hash, v.date)
+			inBatch[hash] = true
+		}
+		// Строка уже в БД, поток получит её при следующем Flush
+		if err := s.publishLine(v, cfg); err != nil {
+			log.Errorf("Error publish(%v):%v", v.raw, err)
 		}
 		cfg.lineAdded++
+		metrics.addLine(v.date)
 		ProgressLine(cfg, "", 0)
 	}
-	return nil
+	if failed > 0 {
+		return len(arrayOfLineOut), fmt.Errorf("%v of %v lines were not written, last error:%v", failed, len(arrayOfLineOut), lastErr)
+	}
+	return len(arrayOfLineOut), nil
 }
 
 func (s *transport) readLastDay(numOfProxy int) string {
@@ -344,103 +580,184 @@ func (s *transport) readLastDate(numOfProxy int) string {
 	return result
 }
 
-func (s *transport) writeToDBTech(cfg *Config, numStart, numEnd int) error {
-	lastDay := cfg.lastDay
+// maxDate - верхняя граница дат для пересчёта scsq_quicktraffic "до конца".
+const maxDate = int64(1) << 40
+
+// Пересчёт scsq_quicktraffic из scsq_traffic для date в интервале (после, до).
+// Параметры: numproxy, после, до, numproxy.
+// par=1 - трафик по пользователям, адресам и статусам за час.
+const quickTrafficByUserSQL = `insert into scsq_quicktraffic (date,login,ipaddress,sizeinbytes,site,httpstatus,par, numproxy)
+	SELECT date, tmp2.login, tmp2.ipaddress, sum(tmp2.sizeinbytes), tmp2.st, tmp2.httpstatus, 1, ?
+	FROM (SELECT case when (SUBSTRING_INDEX(site,'/',1) REGEXP '^(http:\/\/www\.|https:\/\/www\.|http:\/\/|https:\/\/)?[a-z0-9]+([\-\.]{1}[a-z0-9]+)*\.[a-z]{2,5}(:[0-9]{1,5})?(\/.*)?')  
+		then SUBSTRING_INDEX(SUBSTRING_INDEX(site,'/',1),'.',-2)
+		else SUBSTRING_INDEX(site,'/',1) 
+		end as st, sizeinbytes, date, login, ipaddress, httpstatus
+	FROM scsq_traffic
+	where date>? and date<? and numproxy=?
+ 	) as tmp2
+ 	GROUP BY CRC32(tmp2.st),FROM_UNIXTIME(date,'%Y-%m-%d-%H'),login,ipaddress,httpstatus
+	ORDER BY NULL;
+	`
+
+// par=2 - трафик по сайтам за час.
+const quickTrafficBySiteSQL = `insert into scsq_quicktraffic (date,login,ipaddress,sizeinbytes,site,par, numproxy)
+	SELECT tmp2.date, '0', '0', tmp2.sums, tmp2.st, 2, ?
+	FROM (SELECT case
+		when (SUBSTRING_INDEX(site,'/',1) REGEXP '^(http:\/\/www\.|https:\/\/www\.|http:\/\/|https:\/\/)?[a-z0-9]+([\-\.]{1}[a-z0-9]+)*\.[a-z]{2,5}(:[0-9]{1,5})?(\/.*)?')  
+			then SUBSTRING_INDEX(SUBSTRING_INDEX(site,'/',1),'.',-2)
+			else SUBSTRING_INDEX(site,'/',1) 
+		end as st, 
+	sum(sizeinbytes) as sums, date
+	FROM scsq_traffic
+	where date>? and date<? and numproxy=?
+	GROUP BY FROM_UNIXTIME(date,'%Y-%m-%d-%H'),crc32(st),date,site
+	) as tmp2
+	ORDER BY NULL;
+	`
+
+// moveTempTraffic дополняет справочники и переносит строки из scsq_temptraffic в scsq_traffic.
+func (s *transport) moveTempTraffic(cfg *Config) error {
+	return s.moveTempTrafficTx(cfg, nil)
+}
+
+// moveTempTrafficTx выполняет prepare в транзакции переноса перед вставкой в scsq_traffic.
+func (s *transport) moveTempTrafficTx(cfg *Config, prepare func(tx *sql.Tx) error) error {
+	defer s.run.since(phaseMove, time.Now())
+	defer heartbeat.busy("Moving lines to scsq_traffic")()
 	numOfProxy := cfg.NumPrnoxy
-	lineRead := cfg.lineRead
-	lineAdded := cfg.lineAdded
 
 	// t := printTime("Start filling httpstatus, ", cfg.startTime)
 	t := time.Now()
 	ProgressLine(cfg, "Start filling httpstatus", time.Since(t))
-	if _, err := s.db.Exec("INSERT INTO scsq_httpstatus (name) (select tmp.httpstatus from (select distinct httpstatus FROM scsq_temptraffic) as tmp left outer join scsq_httpstatus on tmp.httpstatus=scsq_httpstatus.name where scsq_httpstatus.name is null);"); err != nil {
+	if err := s.exec("filling httpstatus", "INSERT INTO scsq_httpstatus (name) (select tmp.httpstatus from (select distinct httpstatus FROM scsq_temptraffic) as tmp left outer join scsq_httpstatus on tmp.httpstatus=scsq_httpstatus.name where scsq_httpstatus.name is null);"); err != nil {
 		log.Errorf("Error filling httpstatus: %v", err)
 	}
 
 	// t = printTime("Start filling scsq_ipaddress, ", t)
 	ProgressLine(cfg, "Start filling scsq_ipaddress", time.Since(t))
 	t = time.Now()
-	if _, err := s.db.Exec("insert into scsq_ipaddress (name) (select tmp.ipaddress from (select distinct ipaddress from scsq_temptraffic) as tmp left outer join scsq_ipaddress on tmp.ipaddress=scsq_ipaddress.name where scsq_ipaddress.name is null);"); err != nil {
+	if err := s.exec("filling scsq_ipaddress", "insert into scsq_ipaddress (name) (select tmp.ipaddress from (select distinct ipaddress from scsq_temptraffic) as tmp left outer join scsq_ipaddress on tmp.ipaddress=scsq_ipaddress.name where scsq_ipaddress.name is null);"); err != nil {
 		log.Errorf("Error filling scsq_ipaddress: %v", err)
 	}
 
 	// t = printTime("Start filling scsq_logins, ", t)
 	ProgressLine(cfg, "Start filling scsq_logins", time.Since(t))
 	t = time.Now()
-	if _, err := s.db.Exec("insert into scsq_logins (name) (select tmp.login from (select distinct login from scsq_temptraffic) as tmp left outer join scsq_logins on tmp.login=scsq_logins.name where scsq_logins.name is null);"); err != nil {
+	if err := s.exec("filling scsq_logins", "insert into scsq_logins (name) (select tmp.login from (select distinct login from scsq_temptraffic) as tmp left outer join scsq_logins on tmp.login=scsq_logins.name where scsq_logins.name is null);"); err != nil {
 		log.Errorf("Error filling scsq_logins: %v", err)
 	}
 
 	// t = printTime("Start filling scsq_traffic, ", t)
+	// Перенос в scsq_traffic и очистка scsq_temptraffic идут одной транзакцией,
+	// чтобы повтор после обрыва соединения не задвоил данные.
 	ProgressLine(cfg, "Start filling scsq_traffic", time.Since(t))
 	t = time.Now()
-	if _, err := s.db.Exec(`insert into scsq_traffic (date,ipaddress,login,httpstatus,sizeinbytes,site,method,mime,numproxy) select date,tmp.id,scsq_logins.id,scsq_httpstatus.id,sizeinbytes,site,method,mime,numproxy from scsq_temptraffic
-	LEFT JOIN (select id,name from scsq_ipaddress
-	RIGHT JOIN (select distinct ipaddress from scsq_temptraffic) as tt ON scsq_ipaddress.name=tt.ipaddress) as tmp ON scsq_temptraffic.ipaddress=tmp.name
-	LEFT JOIN scsq_logins ON scsq_temptraffic.login=scsq_logins.name
-	LEFT JOIN scsq_httpstatus ON scsq_temptraffic.httpstatus=scsq_httpstatus.name
-	WHERE numproxy=?`, numOfProxy); err != nil {
+	if err := s.retry.do("filling scsq_traffic", func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if prepare != nil {
+			if err := prepare(tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.Exec(`insert into scsq_traffic (date,ipaddress,login,httpstatus,sizeinbytes,site,method,mime,numproxy) select date,tmp.id,scsq_logins.id,scsq_httpstatus.id,sizeinbytes,site,method,mime,numproxy from scsq_temptraffic
+		LEFT JOIN (select id,name from scsq_ipaddress
+		RIGHT JOIN (select distinct ipaddress from scsq_temptraffic) as tt ON scsq_ipaddress.name=tt.ipaddress) as tmp ON scsq_temptraffic.ipaddress=tmp.name
+		LEFT JOIN scsq_logins ON scsq_temptraffic.login=scsq_logins.name
+		LEFT JOIN scsq_httpstatus ON scsq_temptraffic.httpstatus=scsq_httpstatus.name
+		WHERE numproxy=?`, numOfProxy); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`delete from scsq_temptraffic where numproxy=?`, numOfProxy); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if s.dedup != nil {
+			if err := s.dedup.save(tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	}); err != nil {
 		log.Errorf("Error filling scsq_traffic: %v", err)
+		return err
+	}
+	if s.dedup != nil {
+		s.dedup.saved()
 	}
+	return nil
+}
 
-	// t = printTime("Start delete from scsq_temptraffic, ", t)
-	ProgressLine(cfg, "Start delete from scsq_temptraffic", time.Since(t))
-	t = time.Now()
-	if _, err := s.db.Exec(`delete from scsq_temptraffic where numproxy=?`, numOfProxy); err != nil {
-		log.Errorf("Error deleting from scsq_temptraffic: %v", err)
+// fillQuickTraffic пересчитывает оба уровня scsq_quicktraffic для date после lastDay.
+// Удаление и вставка идут одной транзакцией, поэтому повтор после обрыва
+// соединения не задваивает строки, даже если первая попытка успела зафиксироваться.
+func (s *transport) fillQuickTraffic(lastDay string, numProxy int) error {
+	defer heartbeat.busy("Filling scsq_quicktraffic")()
+	return s.retry.do("filling scsq_quicktraffic", func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("delete from scsq_quicktraffic where date>? and numproxy=?", lastDay, numProxy); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(quickTrafficByUserSQL, numProxy, lastDay, maxDate, numProxy); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(quickTrafficBySiteSQL, numProxy, lastDay, maxDate, numProxy); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// writeToDBTech переносит строки в scsq_traffic и пересчитывает scsq_quicktraffic.
+// Ошибка пересчёта возвращается, чтобы checkpoint не сдвинулся: следующий
+// запуск очистит scsq_quicktraffic с последнего дня и пересчитает его заново.
+func (s *transport) writeToDBTech(cfg *Config, numStart, numEnd int) error {
+	lastDay := cfg.lastDay
+	numOfProxy := cfg.NumPrnoxy
+	lineRead := cfg.lineRead
+	lineAdded := cfg.lineAdded
+
+	if err := s.moveTempTraffic(cfg); err != nil {
+		return err
 	}
 
-	// Starting update scsq_quicktraffic
-	// t = printTime("Start filling scsq_quicktraffic, ", t)
+	t := time.Now()
+	quickStart := t
 	ProgressLine(cfg, "Start filling scsq_quicktraffic", time.Since(t))
-	t = time.Now()
-	if _, err := s.db.Exec(`insert into scsq_quicktraffic (date,login,ipaddress,sizeinbytes,site,httpstatus,par, numproxy)
-	SELECT date, tmp2.login, tmp2.ipaddress, sum(tmp2.sizeinbytes), tmp2.st, tmp2.httpstatus, 1, ?
-	FROM (SELECT case when (SUBSTRING_INDEX(site,'/',1) REGEXP '^(http:\/\/www\.|https:\/\/www\.|http:\/\/|https:\/\/)?[a-z0-9]+([\-\.]{1}[a-z0-9]+)*\.[a-z]{2,5}(:[0-9]{1,5})?(\/.*)?')  
-		then SUBSTRING_INDEX(SUBSTRING_INDEX(site,'/',1),'.',-2)
-		else SUBSTRING_INDEX(site,'/',1) 
-		end as st, sizeinbytes, date, login, ipaddress, httpstatus
-	FROM scsq_traffic
-	where date>? and numproxy=?
- 	) as tmp2
- 	GROUP BY CRC32(tmp2.st),FROM_UNIXTIME(date,'%Y-%m-%d-%H'),login,ipaddress,httpstatus
-	ORDER BY NULL;
-	`, numOfProxy, lastDay, numOfProxy); err != nil {
+	if err := s.fillQuickTraffic(lastDay, numOfProxy); err != nil {
 		log.Errorf("Error filling scsq_quicktraffic: %v", err)
+		return err
 	}
-
-	// update2 scsq_quicktraffic
-	// t = printTime("Start update2 scsq_quicktraffic, ", t)
-	ProgressLine(cfg, "Start update2 scsq_quicktraffic", time.Since(t))
-	t = time.Now()
-	if _, err := s.db.Exec(`insert into scsq_quicktraffic (date,login,ipaddress,sizeinbytes,site,par, numproxy)
-	SELECT tmp2.date, '0', '0', tmp2.sums, tmp2.st, 2, ?
-	FROM (SELECT case
-		when (SUBSTRING_INDEX(site,'/',1) REGEXP '^(http:\/\/www\.|https:\/\/www\.|http:\/\/|https:\/\/)?[a-z0-9]+([\-\.]{1}[a-z0-9]+)*\.[a-z]{2,5}(:[0-9]{1,5})?(\/.*)?')  
-			then SUBSTRING_INDEX(SUBSTRING_INDEX(site,'/',1),'.',-2)
-			else SUBSTRING_INDEX(site,'/',1) 
-		end as st, 
-	sum(sizeinbytes) as sums, date
-	FROM scsq_traffic
-	where date>? and numproxy=?
-	GROUP BY FROM_UNIXTIME(date,'%Y-%m-%d-%H'),crc32(st),date,site
-	) as tmp2
-	ORDER BY NULL;
-	`, numOfProxy, lastDay, numOfProxy); err != nil {
-		log.Errorf("Error updating scsq_quicktraffic:%v", err)
-	}
+	s.run.since(phaseQuick, quickStart)
+	metrics.quickTraffic(time.Since(quickStart))
 
 	// t = printTime("Start filling scsq_logtable, ", t)
 	ProgressLine(cfg, "Start filling scsq_logtable", time.Since(t))
 	// t = time.Now()
+	// Подробная история запусков - в scsq_runs, scsq_logtable заполняется для страницы логов Screen Squid.
+	// endTime нужно знать до записи, иначе dateend всегда ноль.
+	cfg.endTime = time.Now()
 	// #fill scsq_logtable
-	if _, err := s.db.Exec(`insert into scsq_logtable (datestart,dateend,message) VALUES (?, ?, ?);`,
-		cfg.startTime.Unix(), cfg.endTime.Unix(), fmt.Sprintf("%v entries read, of which new %v added", lineRead, lineAdded)); err != nil {
+	if err := s.retry.once("filling scsq_logtable", func() error {
+		_, err := s.db.Exec(`insert into scsq_logtable (datestart,dateend,message) VALUES (?, ?, ?);`,
+			cfg.startTime.Unix(), cfg.endTime.Unix(), fmt.Sprintf("%v entries read, of which new %v added, %v rejected, %v duplicates skipped", lineRead, lineAdded, cfg.lineRejected, cfg.lineDuplicate))
+		return err
+	}); err != nil {
 		log.Errorf("Error with filling scsq_logtable: %v", err)
 	}
 
-	ProgressLine(cfg, " execution time:%.8v", time.Since(cfg.startTime))
-	cfg.endTime = time.Now()
+	ProgressLine(cfg, "Data moved", time.Since(t))
 
 	return nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// go.mod требует только go 1.14, поэтому вместо t.TempDir и t.Setenv - свои помощники.
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "go-fetch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestParseLineToStruct(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want lineOfLogType
+		err  error
+	}{
+		{
+			name: "squid native",
+			line: "1600000000.123    150 10.0.0.5 TCP_MISS/200 5120 GET http://example.com/ alice HIER_DIRECT/93.184.216.34 text/html",
+			want: lineOfLogType{
+				date: "1600000000.123", elapsed: "150", ipaddress: "10.0.0.5", httpstatus: "TCP_MISS/200",
+				sizeInBytes: "5120", method: "GET", siteName: "http://example.com/", login: "alice", mime: "text/html",
+			},
+		},
+		{
+			name: "no login",
+			line: "1600000000.5 3 10.0.0.6 TCP_TUNNEL/200 900 CONNECT example.com:443 - HIER_DIRECT/1.2.3.4 -",
+			want: lineOfLogType{
+				date: "1600000000.5", elapsed: "3", ipaddress: "10.0.0.6", httpstatus: "TCP_TUNNEL/200",
+				sizeInBytes: "900", method: "CONNECT", siteName: "example.com:443", login: "-", mime: "-",
+			},
+		},
+		{name: "empty", line: "   ", err: errNotSquidLog},
+		{name: "too few fields", line: "1600000000.5 3 10.0.0.6 TCP_MISS/200 900", err: errTooFewFields},
+		{name: "bad timestamp", line: "2020/09/13 3 10.0.0.6 TCP_MISS/200 900 GET http://a/ - DIRECT/1.2.3.4 -", err: errBadTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLineToStruct(tt.line)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Метрики отдаются в текстовом формате Prometheus: по HTTP на /metrics
+// для follow и в файл для textfile collector'а node_exporter при запуске из cron.
+// Скорость чтения считается в Prometheus через rate(go_fetch_lines_read_total).
+
+// batchBuckets - границы гистограммы времени записи пакета, в секундах.
+var batchBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metricSet struct {
+	sync.Mutex
+	proxy int
+
+	linesRead      int64
+	linesAdded     int64
+	linesDuplicate int64
+	rejected       map[string]int64
+	dbErrors       int64
+	streamDrops    int64
+
+	batchCount   int64
+	batchSum     float64
+	batchBuckets []int64
+
+	quickSeconds float64
+
+	// позиция и время последней строки, зафиксированные checkpoint'ом
+	file          string
+	offset        int64
+	lastLine      float64
+	committedLine float64
+
+	// текущее состояние для /status и /readyz
+	started       time.Time
+	readFile      string
+	readOffset    int64
+	lastBatch     time.Time
+	lastBatchErr  string
+	lastError     string
+	lastErrorTime time.Time
+}
+
+var metrics = &metricSet{
+	rejected:     make(map[string]int64),
+	batchBuckets: make([]int64, len(batchBuckets)),
+}
+
+func metricsFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.httpAddr, "http-addr", "", "Address of HTTP listener for /metrics, /healthz, /readyz and /status, e.g. ':9120', or 'systemd' for a socket passed by systemd")
+	fs.Int64Var(&cfg.readyMaxLag, "ready-max-lag", 10<<20, "/readyz fails if more bytes of the log than this are not committed")
+	fs.StringVar(&cfg.metricsFile, "metrics-file", "", "File to write metrics to for node_exporter textfile collector, e.g. /var/lib/node_exporter/go-fetch.prom")
+}
+
+func (m *metricSet) readLine(file string, offset int64) {
+	m.Lock()
+	m.linesRead++
+	m.readFile, m.readOffset = file, offset
+	m.Unlock()
+}
+
+func (m *metricSet) addLine(date string) {
+	m.Lock()
+	m.linesAdded++
+	if d, err := strconv.ParseFloat(date, 64); err == nil && d > m.lastLine {
+		m.lastLine = d
+	}
+	m.Unlock()
+}
+
+func (m *metricSet) duplicate() {
+	m.Lock()
+	m.linesDuplicate++
+	m.Unlock()
+}
+
+// reject учитывает отклонённые строки. Причина сводится к короткой метке,
+// чтобы текст ошибок БД не плодил новые временные ряды.
+func (m *metricSet) reject(reason string, n int) {
+	label := "db"
+	switch reason {
+	case errNotSquidLog.Error():
+		label = "not_squid_log"
+	case errTooFewFields.Error():
+		label = "too_few_fields"
+	case errBadTimestamp.Error():
+		label = "bad_timestamp"
+	}
+	m.Lock()
+	m.rejected[label] += int64(n)
+	m.Unlock()
+}
+
+func (m *metricSet) dbError() {
+	m.Lock()
+	m.dbErrors++
+	m.Unlock()
+}
+
+func (m *metricSet) streamDropped() {
+	m.Lock()
+	m.streamDrops++
+	m.Unlock()
+}
+
+func (m *metricSet) observeBatch(d time.Duration, err error) {
+	m.Lock()
+	m.lastBatch = time.Now()
+	m.lastBatchErr = ""
+	if err != nil {
+		m.lastBatchErr = err.Error()
+		m.lastError, m.lastErrorTime = err.Error(), m.lastBatch
+	}
+	m.batchCount++
+	m.batchSum += d.Seconds()
+	for i, le := range batchBuckets {
+		if d.Seconds() <= le {
+			m.batchBuckets[i]++
+		}
+	}
+	m.Unlock()
+}
+
+func (m *metricSet) quickTraffic(d time.Duration) {
+	m.Lock()
+	m.quickSeconds = d.Seconds()
+	m.Unlock()
+}
+
+func (m *metricSet) commit(file string, offset int64) {
+	m.Lock()
+	m.file, m.offset = file, offset
+	m.committedLine = m.lastLine
+	m.Unlock()
+}
+
+// writeTo выводит метрики в текстовом формате Prometheus.
+func (m *metricSet) writeTo(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	proxy := fmt.Sprintf(`proxy="%v"`, m.proxy)
+	metric := func(name, typ, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v{%v} %v\n", name, help, name, typ, name, proxy, value)
+	}
+
+	metric("go_fetch_lines_read_total", "counter", "Lines read from the squid log.", m.linesRead)
+	metric("go_fetch_lines_added_total", "counter", "Lines written to the DB.", m.linesAdded)
+	metric("go_fetch_lines_duplicate_total", "counter", "Lines skipped as already imported.", m.linesDuplicate)
+
+	fmt.Fprintf(w, "# HELP go_fetch_lines_rejected_total Lines rejected by reason.\n# TYPE go_fetch_lines_rejected_total counter\n")
+	reasons := make([]string, 0, len(m.rejected))
+	for reason := range m.rejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "go_fetch_lines_rejected_total{%v,reason=%q} %v\n", proxy, reason, m.rejected[reason])
+	}
+
+	metric("go_fetch_db_errors_total", "counter", "Transient DB errors (lost connection, deadlock and so on), including retried ones.", m.dbErrors)
+	metric("go_fetch_stream_dropped_total", "counter", "Records not published because the stream buffer was full.", m.streamDrops)
+
+	fmt.Fprintf(w, "# HELP go_fetch_batch_insert_seconds Time to write a batch of lines to the DB.\n# TYPE go_fetch_batch_insert_seconds histogram\n")
+	for i, le := range batchBuckets {
+		fmt.Fprintf(w, "go_fetch_batch_insert_seconds_bucket{%v,le=\"%v\"} %v\n", proxy, le, m.batchBuckets[i])
+	}
+	fmt.Fprintf(w, "go_fetch_batch_insert_seconds_bucket{%v,le=\"+Inf\"} %v\n", proxy, m.batchCount)
+	fmt.Fprintf(w, "go_fetch_batch_insert_seconds_sum{%v} %v\n", proxy, m.batchSum)
+	fmt.Fprintf(w, "go_fetch_batch_insert_seconds_count{%v} %v\n", proxy, m.batchCount)
+
+	metric("go_fetch_quicktraffic_seconds", "gauge", "Duration of the last scsq_quicktraffic recalculation.", m.quickSeconds)
+
+	if lag, ok := m.lagBytes(); ok {
+		metric("go_fetch_checkpoint_lag_bytes", "gauge", "Bytes of the log not yet committed.", lag)
+	}
+	if m.committedLine > 0 {
+		metric("go_fetch_checkpoint_lag_seconds", "gauge", "Age of the last committed log line.",
+			float64(time.Now().UnixNano())/1e9-m.committedLine)
+	}
+}
+
+// lagBytes - сколько байт лога ещё не зафиксировано checkpoint'ом. Вызывается под m.Lock.
+func (m *metricSet) lagBytes() (int64, bool) {
+	if m.file == "" {
+		return 0, false
+	}
+	stat, err := os.Stat(m.file)
+	if err != nil {
+		return 0, false
+	}
+	lag := stat.Size() - m.offset
+	if lag < 0 {
+		// файл ротирован, checkpoint указывает на старый
+		lag = stat.Size()
+	}
+	return lag, true
+}
+
+func (m *metricSet) setError(err error) {
+	m.Lock()
+	m.lastError, m.lastErrorTime = err.Error(), time.Now()
+	m.Unlock()
+}
+
+// serveHTTP запускает HTTP listener с /metrics и проверками состояния.
+// Ошибка занятого адреса возвращается сразу.
+func serveHTTP(cfg *Config, s *transport) (*http.ServeMux, error) {
+	metrics.Lock()
+	metrics.proxy = cfg.NumPrnoxy
+	metrics.started = time.Now()
+	metrics.Unlock()
+	if cfg.httpAddr == "" {
+		return nil, nil
+	}
+	var ln net.Listener
+	var err error
+	if cfg.httpAddr == "systemd" {
+		ln, err = systemdListener("http")
+	} else if ln, err = net.Listen("tcp", cfg.httpAddr); err != nil {
+		err = fmt.Errorf("Error listen(%v):%v", cfg.httpAddr, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writeTo(w)
+	})
+	healthHandlers(mux, cfg, s)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Errorf("Error in HTTP listener(%v):%v", cfg.httpAddr, err)
+		}
+	}()
+	log.Infof("Serving /metrics, /healthz, /readyz and /status on %v", ln.Addr())
+	return mux, nil
+}
+
+// writeMetricsFile пишет метрики через временный файл, чтобы collector
+// не прочитал файл наполовину.
+func writeMetricsFile(cfg *Config) {
+	if cfg.metricsFile == "" {
+		return
+	}
+	var buf bytes.Buffer
+	metrics.writeTo(&buf)
+	tmp := cfg.metricsFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		log.Errorf("Error write metrics(%v):%v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, cfg.metricsFile); err != nil {
+		log.Errorf("Error rename metrics(%v):%v", tmp, err)
+	}
+}
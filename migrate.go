@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrations - таблицы, которые go-fetch создаёт сам в дополнение к схеме Screen Squid.
+// Все запросы идемпотентны, поэтому migrate можно запускать повторно.
+var migrations = []struct {
+	name  string
+	query string
+}{
+	{"scsq_quarantine", quarantineTableDDL},
+	{"scsq_dedup", dedupTableDDL},
+	{"scsq_runs", runsTableDDL},
+	{"scsq_quota_state", quotaStateTableDDL},
+	{"scsq_quota_events", quotaEventsTableDDL},
+	{"scsq_quota_usage", quotaUsageTableDDL},
+}
+
+func runMigrate(ctx context.Context, cfg *Config) error {
+	store, err := openStore(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for _, m := range migrations {
+		if err := store.exec("creating "+m.name, m.query); err != nil {
+			return err
+		}
+		log.Infof("Table %v is ready", m.name)
+	}
+	return nil
+}
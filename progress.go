@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type progressOptions struct {
+	mode     string
+	interval time.Duration
+}
+
+func progressFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.progress.mode, "progress", "auto", `How to show progress:
+		'auto' - bar on a terminal, otherwise log,
+		'bar' - one line with percent, speed and ETA,
+		'log' - a summary in the log every -progress-interval,
+		'none' - do not show`)
+	fs.DurationVar(&cfg.progress.interval, "progress-interval", 30*time.Second, "How often to log progress when the output is not a terminal")
+}
+
+// progressReporter показывает ход импорта. Вызывается на каждой строке,
+// поэтому время проверяется не чаще раза в checkEvery строк.
+type progressReporter struct {
+	mode     string
+	interval time.Duration
+	n        int
+	last     time.Time
+	started  time.Time
+	// startOffset - позиция в файле на старте, для скорости и ETA
+	startOffset int64
+	width       int
+}
+
+const checkEvery = 256
+
+// reporter по умолчанию ничего не выводит; включается в runImport.
+var reporter = &progressReporter{mode: "none"}
+
+func setupProgress(opts progressOptions, offset int64) error {
+	mode := opts.mode
+	switch mode {
+	case "auto":
+		mode = "log"
+		if stat, err := os.Stdout.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			mode = "bar"
+		}
+	case "bar", "log", "none":
+	default:
+		return fmt.Errorf("Error. progress must be 'auto', 'bar', 'log' or 'none'")
+	}
+	interval := opts.interval
+	if mode == "bar" {
+		interval = 200 * time.Millisecond
+	}
+	reporter = &progressReporter{
+		mode:        mode,
+		interval:    interval,
+		started:     time.Now(),
+		last:        time.Now(),
+		startOffset: offset,
+	}
+	return nil
+}
+
+// ProgressLine отмечает очередную строку (text пустой) или начало этапа
+// переноса данных, since - длительность предыдущего этапа.
+func ProgressLine(cfg *Config, text string, since time.Duration) {
+	r := reporter
+	if r.mode == "none" {
+		return
+	}
+	if text != "" {
+		if r.mode == "bar" {
+			r.print(fmt.Sprintf("%v (%.8v)", text, since))
+		} else {
+			log.Debugf("%v, previous step %.8v", text, since)
+		}
+		return
+	}
+	r.n++
+	if r.n%checkEvery != 0 {
+		return
+	}
+	if time.Since(r.last) < r.interval {
+		return
+	}
+	r.last = time.Now()
+	if r.mode == "bar" {
+		r.print("")
+	} else {
+		log.Infof("Progress: %v", r.summary())
+	}
+}
+
+// finish выводит итог и завершает строку прогресса.
+func (r *progressReporter) finish() {
+	switch r.mode {
+	case "bar":
+		r.print("done in " + fmt.Sprintf("%.8v", time.Since(r.started)))
+		fmt.Println()
+	case "log":
+		log.Infof("Finished in %.8v: %v", time.Since(r.started), r.summary())
+	}
+}
+
+func (r *progressReporter) print(text string) {
+	str := "\r" + r.bar() + " " + r.summary()
+	if text != "" {
+		str += ". " + text
+	}
+	if len(str) > r.width {
+		r.width = len(str)
+	} else {
+		str += strings.Repeat(" ", r.width-len(str))
+	}
+	fmt.Print(str)
+}
+
+// done возвращает долю прочитанного файла, скорость в байтах и оставшееся время.
+func (r *progressReporter) done() (percent float64, speed float64, eta time.Duration, ok bool) {
+	st := metrics.status()
+	if st.File == "" {
+		return 0, 0, 0, false
+	}
+	stat, err := os.Stat(st.File)
+	if err != nil || stat.Size() == 0 {
+		return 0, 0, 0, false
+	}
+	percent = float64(st.Offset) * 100 / float64(stat.Size())
+	if elapsed := time.Since(r.started).Seconds(); elapsed > 0 {
+		speed = float64(st.Offset-r.startOffset) / elapsed
+	}
+	if speed > 0 {
+		eta = time.Duration(float64(stat.Size()-st.Offset)/speed) * time.Second
+	}
+	return percent, speed, eta, true
+}
+
+func (r *progressReporter) bar() string {
+	const width = 30
+	percent, _, _, ok := r.done()
+	if !ok {
+		return "[" + strings.Repeat(" ", width) + "]"
+	}
+	filled := int(percent * width / 100)
+	if filled > width {
+		filled = width
+	}
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+func (r *progressReporter) summary() string {
+	st := metrics.status()
+	str := fmt.Sprintf("lines read/added/rejected %v/%v/%v", st.LinesRead, st.LinesAdded, st.LinesRejected)
+	if percent, speed, eta, ok := r.done(); ok {
+		str = fmt.Sprintf("%5.1f%% %v/s ETA %v, ", percent, formatBytes(speed), eta) + str
+	}
+	return str
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %v", n, units[i])
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type purgeOptions struct {
+	before string
+	days   int
+	chunk  int
+}
+
+func purgeFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.purge.before, "before", "", "Delete traffic older than this date: YYYY-MM-DD[ HH:MM]")
+	fs.IntVar(&cfg.purge.days, "days", 0, "Delete traffic older than this number of days")
+	fs.IntVar(&cfg.purge.chunk, "chunk", 10000, "Delete at most this number of rows per query")
+}
+
+func runPurge(ctx context.Context, cfg *Config) error {
+	var before time.Time
+	switch {
+	case cfg.purge.before != "":
+		var err error
+		if before, err = parseTimeArg(cfg.purge.before, false); err != nil {
+			return err
+		}
+	case cfg.purge.days > 0:
+		before = time.Now().AddDate(0, 0, -cfg.purge.days)
+	default:
+		return fmt.Errorf("Error. -before or -days must be specified")
+	}
+
+	store, err := openStore(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	log.Infof("Deleting traffic of proxy %v older than %v", cfg.NumPrnoxy, before.Format("2006-01-02 15:04"))
+	tables := []string{"scsq_traffic", "scsq_quicktraffic"}
+	// scsq_dedup создаётся только при -dedup index
+	if store.tableExists("scsq_dedup") {
+		tables = append(tables, "scsq_dedup")
+	}
+	for _, table := range tables {
+		deleted, err := store.deleteChunked(ctx, table, before.Unix(), cfg.NumPrnoxy, cfg.purge.chunk)
+		log.Infof("Deleted %v rows from %v", deleted, table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteChunked удаляет строки порциями, чтобы не держать долгие блокировки.
+// По сигналу останавливается между порциями.
+func (s *transport) deleteChunked(ctx context.Context, table string, before int64, numProxy, chunk int) (int64, error) {
+	var total int64
+	for {
+		if ctx.Err() != nil {
+			return total, errInterrupted
+		}
+		heartbeat.alive()
+		deleted, err := s.execAffected("purging "+table,
+			fmt.Sprintf("delete from %v where date<? and numproxy=? limit ?", table), before, numProxy, chunk)
+		total += deleted
+		if err != nil || deleted < int64(chunk) {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// quarantineEntry - отбракованная строка лога вместе с причиной и местом,
+// откуда она была прочитана.
+type quarantineEntry struct {
+	ID     int64     `json:"-"`
+	Time   time.Time `json:"time"`
+	Proxy  int       `json:"proxy"`
+	File   string    `json:"file"`
+	Offset int64     `json:"offset"`
+	Reason string    `json:"reason"`
+	Line   string    `json:"line"`
+}
+
+// quarantine хранит отбракованные строки, чтобы их можно было
+// переобработать командой replay после исправления парсера или схемы.
+type quarantine interface {
+	Put(entries ...quarantineEntry) error
+	Load(numProxy int) ([]quarantineEntry, error)
+	Remove(entries []quarantineEntry) error
+	Close() error
+}
+
+func newQuarantine(cfg *Config, db *sql.DB) (quarantine, error) {
+	switch cfg.quarantineType {
+	case "", "none":
+		return nil, nil
+	case "file":
+		return &fileQuarantine{name: cfg.quarantineFile}, nil
+	case "table":
+		return newTableQuarantine(db)
+	}
+	return nil, fmt.Errorf("Error. quarantine must be 'none', 'file' or 'table', not '%v'", cfg.quarantineType)
+}
+
+// reject отправляет строки в карантин, а если он не настроен - только пишет в лог.
+func (s *transport) reject(lines []lineOfLogType, reason string, cfg *Config) {
+	if len(lines) == 0 {
+		return
+	}
+	cfg.lineRejected += len(lines)
+	metrics.reject(reason, len(lines))
+	if s.quar == nil {
+		log.Errorf("%v lines rejected:%v", len(lines), reason)
+		return
+	}
+	entries := make([]quarantineEntry, 0, len(lines))
+	for _, v := range lines {
+		file := v.source
+		if file == "" {
+			file = cfg.fileLog
+		}
+		entries = append(entries, quarantineEntry{
+			Time:   time.Now(),
+			Proxy:  cfg.NumPrnoxy,
+			File:   file,
+			Offset: v.offset,
+			Reason: reason,
+			Line:   v.raw,
+		})
+	}
+	if err := s.quar.Put(entries...); err != nil {
+		log.Errorf("Error put %v lines to quarantine(%v):%v", len(lines), reason, err)
+	}
+}
+
+// replay заново разбирает и загружает строки из карантина.
+// Запись удаляется из карантина только после того, как её строка перенесена
+// в scsq_traffic (или снова отправлена в карантин), остальные остаются в нём.
+func (s *transport) replay(cfg *Config) error {
+	if s.quar == nil {
+		return fmt.Errorf("Error. quarantine is not configured")
+	}
+	entries, err := s.quar.Load(cfg.NumPrnoxy)
+	if err != nil {
+		return err
+	}
+	log.Infof("Replaying %v lines from quarantine", len(entries))
+
+	var (
+		lines    []lineOfLogType
+		parsed   []quarantineEntry
+		minDate  = ""
+		stillBad int
+	)
+	for _, e := range entries {
+		cfg.lineRead++
+		lineOut, err := parseLineToStruct(replaceQuotes(e.Line))
+		if err != nil {
+			stillBad++
+			continue
+		}
+		lineOut.raw = e.Line
+		lineOut.source = e.File
+		lineOut.offset = e.Offset
+		lines = append(lines, lineOut)
+		parsed = append(parsed, e)
+		if minDate == "" || lineOut.date < minDate {
+			minDate = lineOut.date
+		}
+	}
+	if len(lines) == 0 {
+		log.Infof("Nothing to replay, %v lines still can not be parsed", stillBad)
+		return nil
+	}
+
+	// В scsq_temptraffic могли остаться строки прерванного replay
+	if err := s.clearTempTraffic(cfg.NumPrnoxy); err != nil {
+		return err
+	}
+	// Строки, которые снова не удалось записать, writeArrayToDB вернёт в карантин
+	// отдельными записями, их старые записи удаляются вместе с загруженными.
+	done, writeErr := s.writeArrayToDB(lines, cfg)
+	if errors.Is(writeErr, errDBUnavailable) {
+		return writeErr
+	}
+	if writeErr != nil {
+		log.Warningf("Error in s.writeArrayToDB:%v", writeErr)
+	}
+
+	// Пересчитываем scsq_quicktraffic начиная с дня самой старой загруженной строки
+	date, _ := strconv.ParseFloat(minDate, 64)
+	t := unixToTime(date)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	cfg.lastDay = strconv.FormatInt(day.Unix()-1, 10)
+	if err := s.writeToDBTech(cfg, 0, cfg.lineAdded); err != nil {
+		return err
+	}
+	if err := s.quar.Remove(parsed[:done]); err != nil {
+		return err
+	}
+	if done < len(lines) {
+		return fmt.Errorf("Error. Replay stopped after %v of %v lines, the rest stay in quarantine:%v", done, len(lines), writeErr)
+	}
+	log.Infof("Replayed %v lines, %v lines still can not be parsed", cfg.lineAdded, stillBad)
+	return nil
+}
+
+// fileQuarantine хранит записи в файле, по одной JSON-записи на строку.
+// Файл общий для всех прокси, а их импорт идёт параллельно, поэтому запись
+// и перезапись файла идут под блокировкой.
+type fileQuarantine struct {
+	name string
+}
+
+// lock блокирует отдельный файл name.lock: сам файл карантина Remove
+// заменяет новым, и блокировка старого файла ничего бы не защищала.
+func (q *fileQuarantine) lock() (unlock func(), err error) {
+	name := q.name + ".lock"
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("Error open file(%v):%v", name, err)
+	}
+	if err := waitLockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error lock file(%v):%v", name, err)
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+func (q *fileQuarantine) Put(entries ...quarantineEntry) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := os.OpenFile(q.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("Error open file(%v):%v", q.name, err)
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Load возвращает записи нужного прокси. ID записи - номер строки в файле.
+func (q *fileQuarantine) Load(numProxy int) ([]quarantineEntry, error) {
+	all, err := q.readAll()
+	if err != nil {
+		return nil, err
+	}
+	var entries []quarantineEntry
+	for _, e := range all {
+		if e.Proxy == numProxy {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// Remove удаляет записи по содержимому, а не по номеру строки: после Load
+// другой прокси мог переписать файл, и номера сдвинулись.
+func (q *fileQuarantine) Remove(entries []quarantineEntry) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	all, err := q.readAll()
+	if err != nil {
+		return err
+	}
+	// ключ - запись в JSON, ID в неё не входит
+	removed := make(map[string]int, len(entries))
+	for _, e := range entries {
+		key, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		removed[string(key)]++
+	}
+	tmp := q.name + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("Error open file(%v):%v", tmp, err)
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, e := range all {
+		key, err := json.Marshal(e)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if removed[string(key)] > 0 {
+			removed[string(key)]--
+			continue
+		}
+		if err := enc.Encode(e); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.name)
+}
+
+func (q *fileQuarantine) readAll() ([]quarantineEntry, error) {
+	file, err := os.Open(q.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error open file(%v):%v", q.name, err)
+	}
+	defer file.Close()
+	var entries []quarantineEntry
+	dec := json.NewDecoder(file)
+	for id := int64(0); ; id++ {
+		var e quarantineEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error parse file(%v) record %v:%v", q.name, id, err)
+		}
+		e.ID = id
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (q *fileQuarantine) Close() error {
+	return nil
+}
+
+// tableQuarantine хранит записи в таблице scsq_quarantine.
+type tableQuarantine struct {
+	db *sql.DB
+}
+
+const quarantineTableDDL = `CREATE TABLE IF NOT EXISTS scsq_quarantine (
+	id bigint NOT NULL AUTO_INCREMENT,
+	date int NOT NULL,
+	numproxy int NOT NULL,
+	file varchar(1024) NOT NULL,
+	fileoffset bigint NOT NULL,
+	reason text NOT NULL,
+	line text NOT NULL,
+	PRIMARY KEY (id),
+	KEY numproxy (numproxy)
+)`
+
+func newTableQuarantine(db *sql.DB) (*tableQuarantine, error) {
+	if _, err := db.Exec(quarantineTableDDL); err != nil {
+		return nil, fmt.Errorf("Error create scsq_quarantine:%v", err)
+	}
+	return &tableQuarantine{db: db}, nil
+}
+
+func (q *tableQuarantine) Put(entries ...quarantineEntry) error {
+	stmt, err := q.db.Prepare("INSERT INTO scsq_quarantine (date, numproxy, file, fileoffset, reason, line) VALUES(?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range entries {
+		if _, err := stmt.Exec(e.Time.Unix(), e.Proxy, e.File, e.Offset, e.Reason, e.Line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *tableQuarantine) Load(numProxy int) ([]quarantineEntry, error) {
+	rows, err := q.db.Query("SELECT id, date, numproxy, file, fileoffset, reason, line FROM scsq_quarantine WHERE numproxy=? ORDER BY id", numProxy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []quarantineEntry
+	for rows.Next() {
+		var (
+			e    quarantineEntry
+			date int64
+		)
+		if err := rows.Scan(&e.ID, &date, &e.Proxy, &e.File, &e.Offset, &e.Reason, &e.Line); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(date, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (q *tableQuarantine) Remove(entries []quarantineEntry) error {
+	stmt, err := q.db.Prepare("DELETE FROM scsq_quarantine WHERE id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range entries {
+		if _, err := stmt.Exec(e.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *tableQuarantine) Close() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileQuarantineRemove(t *testing.T) {
+	q := &fileQuarantine{name: filepath.Join(tempDir(t), "quarantine.jsonl")}
+	entry := func(proxy int, line string) quarantineEntry {
+		return quarantineEntry{Time: time.Unix(1600000000, 0), Proxy: proxy, File: "access.log", Reason: "test", Line: line}
+	}
+	if err := q.Put(entry(1, "a"), entry(2, "b"), entry(1, "c"), entry(1, "c")); err != nil {
+		t.Fatal(err)
+	}
+	first, err := q.Load(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// другой прокси переписал файл после Load: номера строк сдвинулись
+	second, err := q.Load(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Remove(second); err != nil {
+		t.Fatal(err)
+	}
+	// одна из двух одинаковых записей остаётся
+	if err := q.Remove(first[:2]); err != nil {
+		t.Fatal(err)
+	}
+	all, err := q.readAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Line != "c" || all[0].Proxy != 1 {
+		t.Errorf("left %+v, want one 'c' of proxy 1", all)
+	}
+}
+
+func TestFileQuarantineParallel(t *testing.T) {
+	q := &fileQuarantine{name: filepath.Join(tempDir(t), "quarantine.jsonl")}
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if err := q.Put(quarantineEntry{Proxy: 2, Line: fmt.Sprint(i)}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			q.Put(quarantineEntry{Proxy: 1, Line: fmt.Sprint(i)})
+			entries, err := q.Load(1)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if err := q.Remove(entries); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+	entries, err := q.Load(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != n {
+		t.Errorf("%v of %v entries of proxy 2 are left", len(entries), n)
+	}
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Квоты описываются в файле -quotas, по одной записи на строку:
+//
+//	# группы и отделы - списки логинов, IP и подсетей; отдел может включать группы
+//	group accounting alice bob 10.0.1.0/24
+//	department finance group:accounting carol
+//	# трафик на эти сайты и их поддомены не считается
+//	exempt windowsupdate.com *.corp.local
+//	# quota <имя> login|ip|group|department=<кто> window=day|week|month [bytes=10G] [requests=N] [reset=...]
+//	quota everyone login=* window=day bytes=1G
+//	quota acc group=accounting window=month bytes=50G requests=1000000 reset=5
+//
+// login=* и ip=* задают квоту каждому логину или адресу отдельно, у группы и
+// отдела квота общая на всех. reset - начало окна: для day время "06:00",
+// для week день недели "mon" (или "mon 06:00"), для month число месяца (1-28).
+
+type quotaOptions struct {
+	file          string
+	blockLogins   string
+	blockIPs      string
+	reloadCommand string
+}
+
+func quotaFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.quota.file, "quotas", "", "File with quota definitions")
+	fs.StringVar(&cfg.quota.blockLogins, "blocklist-logins", "", "File to write logins over quota to, for a Squid proxy_auth ACL")
+	fs.StringVar(&cfg.quota.blockIPs, "blocklist-ips", "", "File to write addresses over quota to, for a Squid src ACL")
+	fs.StringVar(&cfg.quota.reloadCommand, "reload-command", "", "Command to run when a blocklist changes, e.g. 'squid -k reconfigure'")
+}
+
+const quotaStateTableDDL = `CREATE TABLE IF NOT EXISTS scsq_quota_state (
+	quota varchar(64) NOT NULL,
+	numproxy int NOT NULL,
+	subject varchar(255) NOT NULL,
+	windowstart int NOT NULL,
+	windowend int NOT NULL,
+	bytes bigint NOT NULL,
+	requests bigint NOT NULL,
+	exceeded tinyint NOT NULL,
+	updated int NOT NULL,
+	PRIMARY KEY (quota, numproxy, subject)
+)`
+
+const quotaEventsTableDDL = `CREATE TABLE IF NOT EXISTS scsq_quota_events (
+	id bigint NOT NULL AUTO_INCREMENT,
+	date int NOT NULL,
+	numproxy int NOT NULL,
+	quota varchar(64) NOT NULL,
+	subject varchar(255) NOT NULL,
+	windowstart int NOT NULL,
+	bytes bigint NOT NULL,
+	requests bigint NOT NULL,
+	maxbytes bigint NOT NULL,
+	maxrequests bigint NOT NULL,
+	PRIMARY KEY (id),
+	KEY numproxy (numproxy, date)
+)`
+
+// scsq_quota_usage - трафик окна квоты по часам, логинам, адресам и хостам.
+// Часы отсчитываются от начала окна, а не от полуночи, потому что окно может
+// начинаться в любую минуту (reset=06:30).
+const quotaUsageTableDDL = `CREATE TABLE IF NOT EXISTS scsq_quota_usage (
+	numproxy int NOT NULL,
+	windowstart int NOT NULL,
+	hour int NOT NULL,
+	login varchar(255) NOT NULL,
+	ipaddress varchar(255) NOT NULL,
+	host varchar(255) NOT NULL,
+	requests bigint NOT NULL,
+	bytes bigint NOT NULL,
+	KEY numproxy (numproxy, windowstart, hour)
+)`
+
+// quotaRecount - сколько уже посчитанных часов перед последним пересчитывается
+// заново: строки могут прийти в scsq_traffic не по порядку дат. Опоздавшие
+// сильнее (replay, verify -repair) учитываются только со следующего окна.
+const quotaRecount = time.Hour
+
+// members - логины, адреса и подсети группы или отдела.
+type members struct {
+	logins map[string]bool
+	ips    []*net.IPNet
+}
+
+func (m *members) add(value string) {
+	if strings.Contains(value, "/") {
+		if _, ipnet, err := net.ParseCIDR(value); err == nil {
+			m.ips = append(m.ips, ipnet)
+			return
+		}
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * len(ip.To4())
+		if bits == 0 {
+			bits = 128
+		}
+		m.ips = append(m.ips, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return
+	}
+	m.logins[value] = true
+}
+
+func (m *members) has(login, ip string) bool {
+	if m.logins[login] {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	for _, ipnet := range m.ips {
+		if addr != nil && ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type quotaDef struct {
+	name        string
+	kind        string // login, ip, group, department
+	subject     string
+	members     *members
+	window      string // day, week, month
+	maxBytes    int64
+	maxRequests int64
+	// reset: смещение начала окна - время суток, день недели или число месяца
+	resetTime time.Duration
+	resetDay  int
+}
+
+type quotaSet struct {
+	quotas      []*quotaDef
+	exempt      []string
+	groups      map[string]*members
+	departments map[string]*members
+}
+
+// members возвращает состав группы или отдела, nil - если такого нет.
+func (set *quotaSet) members(kind, name string) *members {
+	if kind == "department" {
+		return set.departments[name]
+	}
+	return set.groups[name]
+}
+
+// readQuotas разбирает файл квот. Ошибка в любой строке - ошибка всего файла,
+// чтобы опечатка не сняла ограничения молча.
+func readQuotas(filename string) (*quotaSet, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error open quotas file(%v):%v", filename, err)
+	}
+	defer file.Close()
+
+	groups := map[string]*members{}
+	departments := map[string]*members{}
+	set := &quotaSet{groups: groups, departments: departments}
+	scanner := bufio.NewScanner(file)
+	for num := 1; scanner.Scan(); num++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		errLine := func(format string, a ...interface{}) error {
+			return fmt.Errorf("Error in quotas file(%v) line %v: %v", filename, num, fmt.Sprintf(format, a...))
+		}
+		switch fields[0] {
+		case "group", "department":
+			if len(fields) < 3 {
+				return nil, errLine("expected '%v <name> <member>...'", fields[0])
+			}
+			m := &members{logins: map[string]bool{}}
+			for _, value := range fields[2:] {
+				if strings.HasPrefix(value, "group:") {
+					g, ok := groups[value[len("group:"):]]
+					if !ok || fields[0] == "group" {
+						return nil, errLine("unknown group %v", value)
+					}
+					for login := range g.logins {
+						m.logins[login] = true
+					}
+					m.ips = append(m.ips, g.ips...)
+					continue
+				}
+				m.add(value)
+			}
+			if fields[0] == "group" {
+				groups[fields[1]] = m
+			} else {
+				departments[fields[1]] = m
+			}
+		case "exempt":
+			for _, site := range fields[1:] {
+				set.exempt = append(set.exempt, strings.TrimPrefix(strings.ToLower(site), "*."))
+			}
+		case "quota":
+			q, err := parseQuota(fields[1:], groups, departments)
+			if err != nil {
+				return nil, errLine("%v", err)
+			}
+			set.quotas = append(set.quotas, q)
+		default:
+			return nil, errLine("unknown record %q", fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func parseQuota(fields []string, groups, departments map[string]*members) (*quotaDef, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected 'quota <name> <who>=<value> window=...'")
+	}
+	q := &quotaDef{name: fields[0], window: "day", resetDay: -1}
+	var reset string
+	for i := 1; i < len(fields); i++ {
+		kv := strings.SplitN(fields[i], "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", fields[i])
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "login", "ip":
+			q.kind, q.subject = key, value
+		case "group", "department":
+			q.kind, q.subject = key, value
+			all := groups
+			if key == "department" {
+				all = departments
+			}
+			if q.members = all[value]; q.members == nil {
+				return nil, fmt.Errorf("unknown %v %v", key, value)
+			}
+		case "window":
+			if value != "day" && value != "week" && value != "month" {
+				return nil, fmt.Errorf("window must be 'day', 'week' or 'month'")
+			}
+			q.window = value
+		case "bytes":
+			q.maxBytes, err = parseBytes(value)
+		case "requests":
+			q.maxRequests, err = strconv.ParseInt(value, 10, 64)
+		case "reset":
+			reset = value
+			// "reset=mon 06:00": время может идти следующим полем
+			if i+1 < len(fields) && !strings.Contains(fields[i+1], "=") {
+				i++
+				reset += " " + fields[i]
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad %v %q", key, value)
+		}
+	}
+	if q.kind == "" {
+		return nil, fmt.Errorf("quota %v has no login, ip, group or department", q.name)
+	}
+	if q.maxBytes <= 0 && q.maxRequests <= 0 {
+		return nil, fmt.Errorf("quota %v has neither bytes nor requests", q.name)
+	}
+	if err := q.parseReset(reset); err != nil {
+		return nil, fmt.Errorf("quota %v: %v", q.name, err)
+	}
+	return q, nil
+}
+
+// parseBytes понимает суффиксы K, M, G, T (степени 1024).
+func parseBytes(value string) (int64, error) {
+	value = strings.TrimSuffix(strings.ToUpper(value), "B")
+	mult := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			value = value[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n * mult, err
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (q *quotaDef) parseReset(reset string) error {
+	fields := strings.Fields(reset)
+	if q.window != "day" && len(fields) > 0 {
+		switch q.window {
+		case "week":
+			day, ok := weekdays[strings.ToLower(fields[0])]
+			if !ok {
+				return fmt.Errorf("reset of a week must be a day: mon, tue, ...")
+			}
+			q.resetDay = int(day)
+		case "month":
+			day, err := strconv.Atoi(fields[0])
+			if err != nil || day < 1 || day > 28 {
+				return fmt.Errorf("reset of a month must be a day from 1 to 28")
+			}
+			q.resetDay = day
+		}
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		t, err := time.Parse("15:04", fields[0])
+		if err != nil {
+			return fmt.Errorf("bad reset time %q, expected HH:MM", fields[0])
+		}
+		q.resetTime = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if q.resetDay < 0 {
+		q.resetDay = map[string]int{"day": 0, "week": int(time.Monday), "month": 1}[q.window]
+	}
+	return nil
+}
+
+// windowAt возвращает окно квоты, в которое попадает now.
+func (q *quotaDef) windowAt(now time.Time) (start, end time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch q.window {
+	case "week":
+		start = day.AddDate(0, 0, -((int(day.Weekday()) - q.resetDay + 7) % 7)).Add(q.resetTime)
+		if start.After(now) {
+			start = start.AddDate(0, 0, -7)
+		}
+		return start, start.AddDate(0, 0, 7)
+	case "month":
+		start = time.Date(now.Year(), now.Month(), q.resetDay, 0, 0, 0, 0, now.Location()).Add(q.resetTime)
+		if start.After(now) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start, start.AddDate(0, 1, 0)
+	}
+	start = day.Add(q.resetTime)
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start, start.AddDate(0, 0, 1)
+}
+
+// subjects возвращает, на чьё потребление по квоте q идёт трафик login с адреса ip.
+func (q *quotaDef) subjects(login, ip string) []string {
+	switch q.kind {
+	case "login":
+		if login == "" || login == "-" {
+			return nil
+		}
+		if q.subject == "*" || q.subject == login {
+			return []string{login}
+		}
+	case "ip":
+		if q.subject == "*" || q.subject == ip {
+			return []string{ip}
+		}
+	default:
+		if q.members.has(login, ip) {
+			return []string{q.subject}
+		}
+	}
+	return nil
+}
+
+func (set *quotaSet) exempted(host string) bool {
+	for _, site := range set.exempt {
+		if host == site || strings.HasSuffix(host, "."+site) {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaUsage - потребление одного субъекта по одной квоте в текущем окне.
+type quotaUsage struct {
+	quota    *quotaDef
+	subject  string
+	start    time.Time
+	end      time.Time
+	bytes    int64
+	requests int64
+}
+
+func (u *quotaUsage) exceeded() bool {
+	q := u.quota
+	return (q.maxBytes > 0 && u.bytes >= q.maxBytes) || (q.maxRequests > 0 && u.requests >= q.maxRequests)
+}
+
+// computeQuotaUsage считает потребление по scsq_quota_usage. Она дополняется
+// из scsq_traffic для каждого начала окна: заново считаются только последние
+// часы, а не всё окно. Трафик сгруппирован по логину, адресу и хосту.
+func (s *transport) computeQuotaUsage(ctx context.Context, set *quotaSet, numProxy int, now time.Time) ([]*quotaUsage, error) {
+	byStart := map[time.Time][]*quotaDef{}
+	for _, q := range set.quotas {
+		start, _ := q.windowAt(now)
+		byStart[start] = append(byStart[start], q)
+	}
+	starts := make([]int64, 0, len(byStart))
+	for start := range byStart {
+		starts = append(starts, start.Unix())
+	}
+	if err := s.dropOldQuotaUsage(numProxy, starts); err != nil {
+		return nil, err
+	}
+	usage := map[string]*quotaUsage{}
+	var result []*quotaUsage
+	for start, quotas := range byStart {
+		if err := s.updateQuotaUsage(ctx, numProxy, start.Unix()); err != nil {
+			return nil, err
+		}
+		rows, err := s.db.QueryContext(ctx, `select login, ipaddress, host, sum(requests), sum(bytes)
+		from scsq_quota_usage
+		where numproxy=? and windowstart=?
+		group by login, ipaddress, host`, numProxy, start.Unix())
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var login, ip, host string
+			var requests, bytes int64
+			if err := rows.Scan(&login, &ip, &host, &requests, &bytes); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if set.exempted(strings.ToLower(host)) {
+				continue
+			}
+			for _, q := range quotas {
+				for _, subject := range q.subjects(login, ip) {
+					key := q.name + "\x00" + subject
+					u, ok := usage[key]
+					if !ok {
+						start, end := q.windowAt(now)
+						u = &quotaUsage{quota: q, subject: subject, start: start, end: end}
+						usage[key] = u
+						result = append(result, u)
+					}
+					u.bytes += bytes
+					u.requests += requests
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].quota.name != result[j].quota.name {
+			return result[i].quota.name < result[j].quota.name
+		}
+		return result[i].subject < result[j].subject
+	})
+	return result, nil
+}
+
+// dropOldQuotaUsage удаляет часы окон, которые уже закончились.
+func (s *transport) dropOldQuotaUsage(numProxy int, starts []int64) error {
+	args := []interface{}{numProxy}
+	marks := make([]string, 0, len(starts))
+	for _, start := range starts {
+		args = append(args, start)
+		marks = append(marks, "?")
+	}
+	query := "delete from scsq_quota_usage where numproxy=?"
+	if len(marks) > 0 {
+		query += " and windowstart not in (" + strings.Join(marks, ",") + ")"
+	}
+	return s.exec("deleting old quota usage", query, args...)
+}
+
+// updateQuotaUsage пересчитывает часы окна start начиная с quotaRecountFrom.
+// Удаление и вставка идут одной транзакцией, поэтому повтор не задваивает трафик.
+func (s *transport) updateQuotaUsage(ctx context.Context, numProxy int, start int64) error {
+	var last sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, "select max(hour) from scsq_quota_usage where numproxy=? and windowstart=?",
+		numProxy, start).Scan(&last); err != nil {
+		return err
+	}
+	from := quotaRecountFrom(start, last)
+	return s.retry.do("updating quota usage", func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("delete from scsq_quota_usage where numproxy=? and windowstart=? and hour>=?",
+			numProxy, start, from); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`insert into scsq_quota_usage (numproxy,windowstart,hour,login,ipaddress,host,requests,bytes)
+			select ?, ?, tmp.hour, tmp.login, tmp.ip, tmp.host, count(*), coalesce(sum(tmp.sizeinbytes),0)
+			from (select ?+floor((t.date-?)/3600)*3600 as hour, coalesce(l.name,'') as login, coalesce(ip.name,'') as ip,
+				SUBSTRING_INDEX(SUBSTRING_INDEX(replace(replace(t.site,'https://',''),'http://',''),'/',1),':',1) as host,
+				t.sizeinbytes
+			from scsq_traffic t
+			left join scsq_logins l on t.login=l.id
+			left join scsq_ipaddress ip on t.ipaddress=ip.id
+			where t.date>=? and t.numproxy=?) as tmp
+			group by tmp.hour, tmp.login, tmp.ip, tmp.host`,
+			numProxy, start, start, start, from, numProxy); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// quotaRecountFrom возвращает, с какого момента пересчитывать окно start.
+// last - начало последнего посчитанного часа. Без него окно считается целиком.
+func quotaRecountFrom(start int64, last sql.NullInt64) int64 {
+	if !last.Valid {
+		return start
+	}
+	from := last.Int64 - int64(quotaRecount/time.Second)
+	if from < start {
+		from = start
+	}
+	return from
+}
+
+// saveQuotaState заменяет состояние квот прокси и записывает событие для
+// каждого превышения, которого в этом окне ещё не было.
+func (s *transport) saveQuotaState(usage []*quotaUsage, numProxy int, now time.Time) (events int, err error) {
+	type stateKey struct{ quota, subject string }
+	wasExceeded := map[stateKey]int64{}
+	rows, err := s.db.Query("select quota, subject, windowstart from scsq_quota_state where numproxy=? and exceeded=1", numProxy)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var k stateKey
+		var start int64
+		if err := rows.Scan(&k.quota, &k.subject, &start); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		wasExceeded[k] = start
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	err = s.retry.do("saving quota state", func() error {
+		events = 0
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("delete from scsq_quota_state where numproxy=?", numProxy); err != nil {
+			return err
+		}
+		for _, u := range usage {
+			exceeded := u.exceeded()
+			if _, err := tx.Exec(`insert into scsq_quota_state (quota,numproxy,subject,windowstart,windowend,bytes,requests,exceeded,updated)
+				values (?,?,?,?,?,?,?,?,?)`, u.quota.name, numProxy, u.subject, u.start.Unix(), u.end.Unix(),
+				u.bytes, u.requests, exceeded, now.Unix()); err != nil {
+				return err
+			}
+			if !exceeded {
+				continue
+			}
+			if start, ok := wasExceeded[stateKey{u.quota.name, u.subject}]; ok && start == u.start.Unix() {
+				continue
+			}
+			if _, err := tx.Exec(`insert into scsq_quota_events (date,numproxy,quota,subject,windowstart,bytes,requests,maxbytes,maxrequests)
+				values (?,?,?,?,?,?,?,?,?)`, now.Unix(), numProxy, u.quota.name, u.subject, u.start.Unix(),
+				u.bytes, u.requests, u.quota.maxBytes, u.quota.maxRequests); err != nil {
+				return err
+			}
+			events++
+			log.Warningf("Quota %v exceeded by %v: %v bytes, %v requests since %v", u.quota.name, u.subject,
+				u.bytes, u.requests, u.start.Format("2006-01-02 15:04"))
+		}
+		return tx.Commit()
+	})
+	return events, err
+}
+
+// blocklists возвращает отсортированные логины и адреса (подсети) всех, кто превысил квоту.
+func blocklists(usage []*quotaUsage) (logins, ips []string) {
+	seenLogins := map[string]bool{}
+	seenIPs := map[string]bool{}
+	addLogin := func(v string) {
+		if !seenLogins[v] {
+			seenLogins[v] = true
+			logins = append(logins, v)
+		}
+	}
+	addIP := func(v string) {
+		if !seenIPs[v] {
+			seenIPs[v] = true
+			ips = append(ips, v)
+		}
+	}
+	for _, u := range usage {
+		if !u.exceeded() {
+			continue
+		}
+		switch u.quota.kind {
+		case "login":
+			addLogin(u.subject)
+		case "ip":
+			addIP(u.subject)
+		default:
+			for login := range u.quota.members.logins {
+				addLogin(login)
+			}
+			for _, ipnet := range u.quota.members.ips {
+				addIP(ipnet.String())
+			}
+		}
+	}
+	sort.Strings(logins)
+	sort.Strings(ips)
+	return logins, ips
+}
+
+// writeBlocklist записывает список, только если он изменился, и сообщает об изменении.
+func writeBlocklist(filename string, values []string) (bool, error) {
+	if filename == "" {
+		return false, nil
+	}
+	data := []byte(strings.Join(values, "\n"))
+	if len(values) > 0 {
+		data = append(data, '\n')
+	}
+	if old, err := ioutil.ReadFile(filename); err == nil && string(old) == string(data) {
+		return false, nil
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return false, fmt.Errorf("Error write blocklist(%v):%v", tmp, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return false, fmt.Errorf("Error rename blocklist(%v):%v", tmp, err)
+	}
+	return true, nil
+}
+
+func runQuota(ctx context.Context, cfg *Config) error {
+	opts := &cfg.quota
+	if opts.file == "" {
+		return fmt.Errorf("Error. -quotas must be set")
+	}
+	set, err := readQuotas(opts.file)
+	if err != nil {
+		return err
+	}
+
+	// Подсчёт только читает scsq_traffic, поэтому блокировка импорта не нужна,
+	// а два запуска quota одного прокси разделяет своя блокировка.
+	lock, err := acquireLock(quotaLockFileName(cfg.PIDFileName, cfg.NumPrnoxy))
+	if err != nil {
+		return err
+	}
+	store, err := openStore(ctx, cfg, false)
+	if err != nil {
+		lock.release()
+		return err
+	}
+	store.lock = lock
+	defer store.Close()
+	for _, ddl := range []string{quotaStateTableDDL, quotaEventsTableDDL, quotaUsageTableDDL} {
+		if err := store.exec("creating quota tables", ddl); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	usage, err := store.computeQuotaUsage(ctx, set, cfg.NumPrnoxy, now)
+	if err != nil {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		return fmt.Errorf("Error computing quota usage:%v", err)
+	}
+	events, err := store.saveQuotaState(usage, cfg.NumPrnoxy, now)
+	if err != nil {
+		return fmt.Errorf("Error saving quota state:%v", err)
+	}
+
+	logins, ips := blocklists(usage)
+	changedLogins, err := writeBlocklist(opts.blockLogins, logins)
+	if err != nil {
+		return err
+	}
+	changedIPs, err := writeBlocklist(opts.blockIPs, ips)
+	if err != nil {
+		return err
+	}
+	log.Infof("Quotas checked: %v subjects, %v new breaches, %v logins and %v addresses over quota",
+		len(usage), events, len(logins), len(ips))
+
+	if (changedLogins || changedIPs) && opts.reloadCommand != "" {
+		out, err := exec.CommandContext(ctx, "/bin/sh", "-c", opts.reloadCommand).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Error running reload command(%v):%v: %s", opts.reloadCommand, err, out)
+		}
+		log.Infof("Blocklist changed, ran %v", opts.reloadCommand)
+	}
+	return nil
+}
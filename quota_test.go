@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		err   bool
+	}{
+		{"1024", 1024, false},
+		{"10K", 10 << 10, false},
+		{"512mb", 512 << 20, false},
+		{"1G", 1 << 30, false},
+		{"2T", 2 << 40, false},
+		{"1.5G", 0, true},
+		{"G", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseBytes(tt.value)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if !tt.err && got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	groups := map[string]*members{"accounting": {logins: map[string]bool{"alice": true}}}
+	departments := map[string]*members{}
+	tests := []struct {
+		line string
+		want quotaDef
+		err  string
+	}{
+		{
+			line: "everyone login=* window=day bytes=1G",
+			want: quotaDef{name: "everyone", kind: "login", subject: "*", window: "day", maxBytes: 1 << 30},
+		},
+		{
+			line: "acc group=accounting window=month bytes=50G requests=1000 reset=5",
+			want: quotaDef{name: "acc", kind: "group", subject: "accounting", window: "month",
+				maxBytes: 50 << 30, maxRequests: 1000, resetDay: 5},
+		},
+		{
+			line: "weekly ip=10.0.0.5 window=week requests=10 reset=fri 06:30",
+			want: quotaDef{name: "weekly", kind: "ip", subject: "10.0.0.5", window: "week",
+				maxRequests: 10, resetDay: int(time.Friday), resetTime: 6*time.Hour + 30*time.Minute},
+		},
+		{line: "q", err: "expected 'quota"},
+		{line: "q window=day bytes=1G", err: "has no login"},
+		{line: "q login=* window=day", err: "has neither bytes nor requests"},
+		{line: "q login=* window=year bytes=1G", err: "window must be"},
+		{line: "q group=sales bytes=1G", err: "unknown group sales"},
+		{line: "q login=* bytes=lots", err: `bad bytes "lots"`},
+		{line: "q login=* bytes=1G size=2", err: `unknown key "size"`},
+		{line: "q login=* window=month bytes=1G reset=31", err: "from 1 to 28"},
+		{line: "q login=* window=week bytes=1G reset=someday", err: "must be a day"},
+		{line: "q login=* bytes=1G reset=25:00", err: "bad reset time"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			q, err := parseQuota(strings.Fields(tt.line), groups, departments)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.members = nil
+			if *q != tt.want {
+				t.Errorf("got %+v, want %+v", *q, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowAt(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name       string
+		quota      quotaDef
+		now        string
+		start, end string
+	}{
+		{"day", quotaDef{window: "day"}, "2026-10-19 10:00", "2026-10-19 00:00", "2026-10-20 00:00"},
+		{"day before reset", quotaDef{window: "day", resetTime: 6 * time.Hour}, "2026-10-19 05:59", "2026-10-18 06:00", "2026-10-19 06:00"},
+		{"day after reset", quotaDef{window: "day", resetTime: 6 * time.Hour}, "2026-10-19 06:00", "2026-10-19 06:00", "2026-10-20 06:00"},
+		// 2026-10-19 - понедельник
+		{"week", quotaDef{window: "week", resetDay: int(time.Monday)}, "2026-10-21 12:00", "2026-10-19 00:00", "2026-10-26 00:00"},
+		{"week before reset", quotaDef{window: "week", resetDay: int(time.Monday), resetTime: 6 * time.Hour}, "2026-10-19 05:00", "2026-10-12 06:00", "2026-10-19 06:00"},
+		{"week from friday", quotaDef{window: "week", resetDay: int(time.Friday)}, "2026-10-19 12:00", "2026-10-16 00:00", "2026-10-23 00:00"},
+		{"month", quotaDef{window: "month", resetDay: 1}, "2026-10-19 12:00", "2026-10-01 00:00", "2026-11-01 00:00"},
+		{"month before reset", quotaDef{window: "month", resetDay: 25}, "2026-01-19 12:00", "2025-12-25 00:00", "2026-01-25 00:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.quota.windowAt(at(tt.now))
+			if !start.Equal(at(tt.start)) || !end.Equal(at(tt.end)) {
+				t.Errorf("got %v - %v, want %v - %v", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestQuotaRecountFrom(t *testing.T) {
+	const start = 1700000000
+	tests := []struct {
+		name string
+		last sql.NullInt64
+		want int64
+	}{
+		{"first run", sql.NullInt64{}, start},
+		{"first hour", sql.NullInt64{Int64: start, Valid: true}, start},
+		{"later", sql.NullInt64{Int64: start + 5*3600, Valid: true}, start + 4*3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quotaRecountFrom(start, tt.last); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func rebuildFlags(fs *flag.FlagSet, cfg *Config) {
+	periodFlags(fs, &cfg.rebuild, "yesterday", "yesterday")
+	metricsFlags(fs, cfg)
+}
+
+// runRebuild удаляет и заново считает scsq_quicktraffic из scsq_traffic
+// за указанный период, по одному дню за раз.
+func runRebuild(ctx context.Context, cfg *Config) error {
+	if err := cfg.rebuild.parse(); err != nil {
+		return err
+	}
+
+	store, err := openStore(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if _, err := serveHTTP(cfg, store); err != nil {
+		return err
+	}
+	defer writeMetricsFile(cfg)
+
+	// scsq_quicktraffic хранит трафик по часам, поэтому период расширяется
+	// до целых часов: неполный час задвоился бы или обрезался
+	from, to := hourStart(cfg.rebuild.from), hourStart(cfg.rebuild.to)
+	if to.Before(cfg.rebuild.to) {
+		to = to.Add(time.Hour)
+	}
+	if !from.Equal(cfg.rebuild.from) || !to.Equal(cfg.rebuild.to) {
+		log.Warningf("Period %v - %v is extended to whole hours", cfg.rebuild.fromStr, cfg.rebuild.toStr)
+	}
+	days := int(to.Sub(from).Hours()/24 + 0.5)
+	if days < 1 {
+		days = 1
+	}
+	log.Infof("Rebuilding scsq_quicktraffic of proxy %v for %v - %v", cfg.NumPrnoxy,
+		from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"))
+
+	n := 0
+	began := time.Now()
+	for start := from; start.Before(to); start = nextDay(start) {
+		// каждый день пересчитывается в своей транзакции, остановиться можно между днями
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		heartbeat.alive()
+		end := nextDay(start)
+		if end.After(to) {
+			end = to
+		}
+		n++
+		t := time.Now()
+		if err := store.rebuildQuickTraffic(cfg.NumPrnoxy, start.Unix(), end.Unix()); err != nil {
+			return fmt.Errorf("Error rebuilding %v:%v", start.Format("2006-01-02"), err)
+		}
+		log.Infof("Rebuilt %v (%v/%v) in %.8v", start.Format("2006-01-02"), n, days, time.Since(t))
+	}
+	metrics.quickTraffic(time.Since(began))
+
+	return store.checkQuickTraffic(cfg.NumPrnoxy, from.Unix(), to.Unix())
+}
+
+// hourStart возвращает начало часа по местному времени, как FROM_UNIXTIME в MySQL.
+// Truncate здесь не подходит: он считает часы от UTC, а пояс может быть сдвинут на полчаса.
+func hourStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+func nextDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+}
+
+// rebuildQuickTraffic пересчитывает оба уровня scsq_quicktraffic за [from, to)
+// в одной транзакции, чтобы отчёты не видели пустой день.
+func (s *transport) rebuildQuickTraffic(numProxy int, from, to int64) error {
+	defer heartbeat.busy("Rebuilding scsq_quicktraffic")()
+	return s.retry.do("rebuilding scsq_quicktraffic", func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("delete from scsq_quicktraffic where date>=? and date<? and numproxy=?", from, to, numProxy); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(quickTrafficByUserSQL, numProxy, from-1, to, numProxy); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(quickTrafficBySiteSQL, numProxy, from-1, to, numProxy); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// checkQuickTraffic сверяет объём трафика за период в scsq_traffic
+// с суммами обоих уровней scsq_quicktraffic.
+func (s *transport) checkQuickTraffic(numProxy int, from, to int64) error {
+	var traffic, byUser, bySite int64
+	if err := s.db.QueryRow("select coalesce(sum(sizeinbytes),0) from scsq_traffic where date>=? and date<? and numproxy=?",
+		from, to, numProxy).Scan(&traffic); err != nil {
+		return err
+	}
+	if err := s.db.QueryRow("select coalesce(sum(case when par=1 then sizeinbytes else 0 end),0), coalesce(sum(case when par=2 then sizeinbytes else 0 end),0) from scsq_quicktraffic where date>=? and date<? and numproxy=?",
+		from, to, numProxy).Scan(&byUser, &bySite); err != nil {
+		return err
+	}
+	log.Infof("Bytes in scsq_traffic:%v, scsq_quicktraffic par=1:%v, par=2:%v", traffic, byUser, bySite)
+	if traffic != byUser || traffic != bySite {
+		return fmt.Errorf("Error. scsq_quicktraffic does not match scsq_traffic: %v, %v, %v bytes", traffic, byUser, bySite)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type reportOptions struct {
+	period period
+	by     string
+	top    int
+	format string
+	output string
+	// фильтры для детализации: пользователь -> сайты, сайт -> пользователи
+	user string
+	ip   string
+	site string
+}
+
+func reportFlags(fs *flag.FlagSet, cfg *Config) {
+	opts := &cfg.report
+	periodFlags(fs, &opts.period, "yesterday", "yesterday")
+	fs.StringVar(&opts.by, "by", "user", "Group traffic by: 'user', 'ip', 'site', 'mime' or 'status'")
+	fs.IntVar(&opts.top, "top", 10, "Number of rows, 0 - all")
+	fs.StringVar(&opts.format, "format", "table", "Output format: 'table', 'csv' or 'json' (one object per line)")
+	fs.StringVar(&opts.output, "o", "-", "Output file, '-' for stdout")
+	fs.StringVar(&opts.user, "user", "", "Only traffic of this login, e.g. -user alice -by site")
+	fs.StringVar(&opts.ip, "ip", "", "Only traffic of this address")
+	fs.StringVar(&opts.site, "site", "", "Only traffic to this site, e.g. -site example.com -by user")
+}
+
+type reportRow struct {
+	Rank    int     `json:"rank"`
+	Name    string  `json:"name"`
+	Bytes   int64   `json:"bytes"`
+	Percent float64 `json:"percent"`
+}
+
+// reportColumns - выражение для группировки по каждому разрезу. MIME есть
+// только в scsq_traffic, остальное берётся из почасовой scsq_quicktraffic.
+var reportColumns = map[string]string{
+	"user":   "coalesce(l.name,'')",
+	"ip":     "coalesce(ip.name,'')",
+	"site":   "t.site",
+	"status": "coalesce(h.name,'')",
+	"mime":   "t.mime",
+}
+
+// reportQuery собирает условие и параметры запроса для отчёта.
+// numProxy 0 - все прокси (для API).
+func reportQuery(opts *reportOptions, numProxy int) (from, where string, args []interface{}) {
+	from = `scsq_quicktraffic t
+	left join scsq_logins l on t.login=l.id
+	left join scsq_ipaddress ip on t.ipaddress=ip.id
+	left join scsq_httpstatus h on t.httpstatus=h.id`
+	where = "t.par=1 and t.date>=? and t.date<?"
+	siteCond := " and t.site=?"
+	site := opts.site
+	if opts.by == "mime" {
+		from = strings.Replace(from, "scsq_quicktraffic", "scsq_traffic", 1)
+		where = "t.date>=? and t.date<?"
+		// в scsq_traffic адрес целиком
+		siteCond = " and t.site like ?"
+		site = "%" + site + "%"
+	}
+	args = []interface{}{opts.period.from.Unix(), opts.period.to.Unix()}
+	if numProxy > 0 {
+		where += " and t.numproxy=?"
+		args = append(args, numProxy)
+	}
+	if opts.user != "" {
+		where += " and l.name=?"
+		args = append(args, opts.user)
+	}
+	if opts.ip != "" {
+		where += " and ip.name=?"
+		args = append(args, opts.ip)
+	}
+	if opts.site != "" {
+		where += siteCond
+		args = append(args, site)
+	}
+	return from, where, args
+}
+
+func runReport(ctx context.Context, cfg *Config) error {
+	opts := &cfg.report
+	if _, ok := reportColumns[opts.by]; !ok {
+		return fmt.Errorf("Error. by must be 'user', 'ip', 'site', 'mime' or 'status'")
+	}
+	if opts.format != "table" && opts.format != "csv" && opts.format != "json" {
+		return fmt.Errorf("Error. format must be 'table', 'csv' or 'json'")
+	}
+	if err := opts.period.parse(); err != nil {
+		return err
+	}
+
+	store, err := openStore(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, total, err := store.topTraffic(ctx, opts, cfg.NumPrnoxy)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if opts.output != "-" {
+		file, err := os.Create(opts.output)
+		if err != nil {
+			return fmt.Errorf("Error open file(%v):%v", opts.output, err)
+		}
+		defer file.Close()
+		out = file
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	return writeReport(w, cfg, report, total)
+}
+
+// topTraffic возвращает первые opts.top строк отчёта и общий объём.
+func (s *transport) topTraffic(ctx context.Context, opts *reportOptions, numProxy int) ([]reportRow, int64, error) {
+	from, where, args := reportQuery(opts, numProxy)
+	var total int64
+	if err := s.db.QueryRowContext(ctx, "select coalesce(sum(t.sizeinbytes),0) from "+from+" where "+where,
+		args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := "select " + reportColumns[opts.by] + " as name, sum(t.sizeinbytes) as bytes from " + from + " where " + where +
+		" group by name order by bytes desc"
+	if opts.top > 0 {
+		query += " limit " + strconv.Itoa(opts.top)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var report []reportRow
+	for rows.Next() {
+		r := reportRow{Rank: len(report) + 1}
+		if err := rows.Scan(&r.Name, &r.Bytes); err != nil {
+			return nil, 0, err
+		}
+		if total > 0 {
+			r.Percent = float64(r.Bytes) * 100 / float64(total)
+		}
+		report = append(report, r)
+	}
+	return report, total, rows.Err()
+}
+
+func writeReport(w io.Writer, cfg *Config, report []reportRow, total int64) error {
+	opts := &cfg.report
+	switch opts.format {
+	case "csv":
+		csvw := csv.NewWriter(w)
+		csvw.Write([]string{"rank", opts.by, "bytes", "percent"})
+		for _, r := range report {
+			csvw.Write([]string{strconv.Itoa(r.Rank), r.Name, strconv.FormatInt(r.Bytes, 10), strconv.FormatFloat(r.Percent, 'f', 2, 64)})
+		}
+		csvw.Flush()
+		return csvw.Error()
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, r := range report {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fmt.Fprintf(w, "Top %v by %v of proxy %v, %v - %v", len(report), opts.by, cfg.NumPrnoxy,
+		opts.period.from.Format("2006-01-02 15:04"), opts.period.to.Format("2006-01-02 15:04"))
+	for _, f := range []struct{ name, value string }{{"user", opts.user}, {"ip", opts.ip}, {"site", opts.site}} {
+		if f.value != "" {
+			fmt.Fprintf(w, ", %v %v", f.name, f.value)
+		}
+	}
+	fmt.Fprintf(w, "\nTotal: %v\n\n", formatBytes(float64(total)))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "#\t%v\tbytes\t%%\t\n", opts.by)
+	for _, r := range report {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.1f\t\n", r.Rank, r.Name, formatBytes(float64(r.Bytes)), r.Percent)
+	}
+	return tw.Flush()
+}
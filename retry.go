@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// errDBUnavailable означает, что БД не отвечает даже после всех повторов.
+// Импорт в этом случае прерывается без записи checkpoint'а,
+// чтобы следующий запуск продолжил с последней зафиксированной позиции.
+var errDBUnavailable = errors.New("database is unavailable")
+
+// retryPolicy - повторы с экспоненциальной задержкой и случайным разбросом.
+// Отмена ctx прерывает ожидание перед следующим повтором.
+type retryPolicy struct {
+	ctx      context.Context
+	attempts int
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// do выполняет fn, повторяя её при временных ошибках БД.
+// Постоянные ошибки возвращаются сразу, временные после исчерпания
+// повторов или отмены ctx оборачиваются в errDBUnavailable.
+// Повторять можно только идемпотентные запросы: после обрыва соединения
+// неизвестно, выполнила ли БД запрос. Одиночные вставки идут через once.
+func (p retryPolicy) do(op string, fn func() error) error {
+	ctx := p.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		metrics.dbError()
+		if attempt >= p.attempts {
+			break
+		}
+		wait := p.backoff(attempt)
+		log.Warningf("Transient error in %v (attempt %v of %v), retry in %v:%v", op, attempt+1, p.attempts, wait, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v, interrupted while waiting to retry:%v", errDBUnavailable, op, err)
+		case <-time.After(wait):
+		}
+	}
+	return fmt.Errorf("%w: %v:%v", errDBUnavailable, op, err)
+}
+
+// once выполняет fn без повторов. Временная ошибка сразу оборачивается
+// в errDBUnavailable: запрос мог дойти до БД, и повтор задвоил бы данные.
+func (p retryPolicy) once(op string, fn func() error) error {
+	err := fn()
+	if err == nil || !isTransient(err) {
+		return err
+	}
+	metrics.dbError()
+	return fmt.Errorf("%w: %v:%v", errDBUnavailable, op, err)
+}
+
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.delay << uint(attempt)
+	if d <= 0 || d > p.maxDelay {
+		d = p.maxDelay
+	}
+	// половина задержки фиксирована, вторая половина случайна
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isTransient определяет ошибки, после которых имеет смысл повторить запрос:
+// обрыв соединения, deadlock, lock wait timeout, ошибка сериализации,
+// слишком много соединений.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1040, // ER_CON_COUNT_ERROR
+			1053, // ER_SERVER_SHUTDOWN
+			1205, // ER_LOCK_WAIT_TIMEOUT
+			1213, // ER_LOCK_DEADLOCK
+			2006, // CR_SERVER_GONE_ERROR
+			2013: // CR_SERVER_LOST
+			return true
+		}
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"53300", // too_many_connections
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		// класс 08 - connection exception
+		return pqErr.Code.Class() == "08"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
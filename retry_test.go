@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"bad conn", driver.ErrBadConn, true},
+		{"invalid conn", mysql.ErrInvalidConn, true},
+		{"wrapped eof", fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), true},
+		{"mysql deadlock", &mysql.MySQLError{Number: 1213}, true},
+		{"mysql lock wait", &mysql.MySQLError{Number: 1205}, true},
+		{"mysql gone away", &mysql.MySQLError{Number: 2006}, true},
+		{"mysql duplicate", &mysql.MySQLError{Number: 1062}, false},
+		{"mysql syntax", &mysql.MySQLError{Number: 1064}, false},
+		{"pq serialization", &pq.Error{Code: "40001"}, true},
+		{"pq connection", &pq.Error{Code: "08006"}, true},
+		{"pq unique", &pq.Error{Code: "23505"}, false},
+		{"net", &net.OpError{Op: "dial", Err: errors.New("timeout")}, true},
+		{"refused", fmt.Errorf("connect: %w", syscall.ECONNREFUSED), true},
+		{"other", errors.New("no such table"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{delay: time.Second, maxDelay: 10 * time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{70, 10 * time.Second}, // сдвиг за пределы int64
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := p.backoff(tt.attempt); got < tt.max/2 || got > tt.max {
+					t.Fatalf("got %v, want %v - %v", got, tt.max/2, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	p := retryPolicy{attempts: 2, delay: time.Millisecond, maxDelay: time.Millisecond}
+	tests := []struct {
+		name  string
+		errs  []error
+		calls int
+		want  error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"recovered", []error{driver.ErrBadConn, nil}, 2, nil},
+		{"permanent", []error{errors.New("syntax")}, 1, nil},
+		{"unavailable", []error{driver.ErrBadConn, driver.ErrBadConn, driver.ErrBadConn}, 3, errDBUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := p.do("test", func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if calls != tt.calls {
+				t.Errorf("%v calls, want %v", calls, tt.calls)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && err != tt.errs[len(tt.errs)-1] {
+				t.Errorf("got %v, want %v", err, tt.errs[len(tt.errs)-1])
+			}
+		})
+	}
+}
+
+func TestRetryDoCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := retryPolicy{ctx: ctx, attempts: 5, delay: time.Hour, maxDelay: time.Hour}
+	calls := 0
+	start := time.Now()
+	err := p.do("test", func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+	if !errors.Is(err, errDBUnavailable) {
+		t.Errorf("got %v, want %v", err, errDBUnavailable)
+	}
+	if calls != 1 {
+		t.Errorf("%v calls, want 1", calls)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("waited %v after cancel", time.Since(start))
+	}
+}
+
+func TestRetryOnce(t *testing.T) {
+	var p retryPolicy
+	tests := []struct {
+		name   string
+		err    error
+		want   error
+		errors int64
+	}{
+		{"success", nil, nil, 0},
+		{"permanent", errors.New("syntax"), nil, 0},
+		{"lost", &mysql.MySQLError{Number: 2013}, errDBUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := metrics.dbErrors
+			calls := 0
+			err := p.once("test", func() error {
+				calls++
+				return tt.err
+			})
+			if calls != 1 {
+				t.Errorf("%v calls, want 1", calls)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			// постоянные ошибки в go_fetch_db_errors_total не считаются
+			if got := metrics.dbErrors - before; got != tt.errors {
+				t.Errorf("%v DB errors counted, want %v", got, tt.errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Фазы запуска, длительность которых сохраняется в scsq_runs.
+const (
+	phasePrepare = iota
+	phaseInsert
+	phaseMove
+	phaseQuick
+	numPhases
+)
+
+var errInterrupted = errors.New("interrupted by signal")
+
+const runsTableDDL = `CREATE TABLE IF NOT EXISTS scsq_runs (
+	id bigint NOT NULL AUTO_INCREMENT,
+	numproxy int NOT NULL,
+	command varchar(32) NOT NULL,
+	files varchar(1024) NOT NULL,
+	offsetstart bigint NOT NULL,
+	offsetend bigint NOT NULL,
+	datestart int NOT NULL,
+	dateend int NOT NULL,
+	linesread bigint NOT NULL DEFAULT 0,
+	linesparsed bigint NOT NULL DEFAULT 0,
+	linesrejected bigint NOT NULL DEFAULT 0,
+	linesduplicate bigint NOT NULL DEFAULT 0,
+	linesadded bigint NOT NULL DEFAULT 0,
+	preparems bigint NOT NULL DEFAULT 0,
+	insertms bigint NOT NULL DEFAULT 0,
+	movems bigint NOT NULL DEFAULT 0,
+	quickms bigint NOT NULL DEFAULT 0,
+	status varchar(16) NOT NULL,
+	error text,
+	PRIMARY KEY (id),
+	KEY numproxy (numproxy, datestart)
+)`
+
+// runRecord - строка scsq_runs текущего запуска. Счётчики строк берутся из cfg.
+type runRecord struct {
+	id          int64
+	cfg         *Config
+	command     string
+	offsetStart int64
+	offsetEnd   int64
+	phases      [numPhases]time.Duration
+}
+
+// since добавляет к фазе время, прошедшее с t. Вне импорта записи нет, и вызов ничего не делает.
+func (r *runRecord) since(phase int, t time.Time) {
+	if r != nil {
+		r.phases[phase] += time.Since(t)
+	}
+}
+
+// startRun добавляет в scsq_runs запись со статусом running.
+// История запусков не должна мешать импорту, поэтому ошибки только логируются.
+func (s *transport) startRun(cfg *Config, command string) {
+	if err := s.exec("creating scsq_runs", runsTableDDL); err != nil {
+		log.Errorf("Error create scsq_runs:%v", err)
+		return
+	}
+	run := &runRecord{cfg: cfg, command: command}
+	err := s.retry.once("inserting into scsq_runs", func() error {
+		result, err := s.db.Exec(`insert into scsq_runs (numproxy, command, files, offsetstart, offsetend, datestart, dateend, status)
+			values (?, ?, ?, 0, 0, ?, ?, 'running')`,
+			cfg.NumPrnoxy, command, cfg.fileLog, cfg.startTime.Unix(), cfg.startTime.Unix())
+		if err != nil {
+			return err
+		}
+		run.id, err = result.LastInsertId()
+		return err
+	})
+	if err != nil {
+		log.Errorf("Error inserting into scsq_runs:%v", err)
+		return
+	}
+	s.run = run
+	log.Debugf("Run %v is recorded in scsq_runs with id %v", currentRunID(), run.id)
+}
+
+// updateRun сохраняет текущие счётчики. В режиме follow вызывается после каждой фиксации.
+func (s *transport) updateRun(status, message string) {
+	if s.run == nil {
+		return
+	}
+	r, cfg := s.run, s.run.cfg
+	ms := func(phase int) int64 { return int64(r.phases[phase] / time.Millisecond) }
+	if err := s.exec("updating scsq_runs", `update scsq_runs set offsetstart=?, offsetend=?, dateend=?,
+		linesread=?, linesparsed=?, linesrejected=?, linesduplicate=?, linesadded=?,
+		preparems=?, insertms=?, movems=?, quickms=?, status=?, error=? where id=?`,
+		r.offsetStart, r.offsetEnd, time.Now().Unix(),
+		cfg.lineRead, cfg.lineParsed, cfg.lineRejected, cfg.lineDuplicate, cfg.lineAdded,
+		ms(phasePrepare), ms(phaseInsert), ms(phaseMove), ms(phaseQuick), status, message, r.id); err != nil {
+		log.Errorf("Error updating scsq_runs:%v", err)
+	}
+}
+
+// finishRun записывает итог запуска по ошибке, с которой он завершился.
+func (s *transport) finishRun(err error) {
+	switch {
+	case err == nil:
+		s.updateRun("ok", "")
+	case errors.Is(err, errInterrupted):
+		s.updateRun("interrupted", err.Error())
+	default:
+		s.updateRun("failed", err.Error())
+	}
+}
+
+type statusOptions struct {
+	last  int
+	stale time.Duration
+}
+
+func statusFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.IntVar(&cfg.status.last, "last", 20, "Number of recent runs to show")
+	fs.DurationVar(&cfg.status.stale, "stale", 2*time.Hour, "Flag running runs not updated for this long")
+}
+
+type runRow struct {
+	id                                       int64
+	command, files, status, message          string
+	dateStart, dateEnd                       int64
+	read, parsed, rejected, duplicate, added int64
+	prepareMs, insertMs, moveMs, quickMs     int64
+}
+
+// runStatus возвращает пометку для неудачного или подозрительного запуска.
+func runStatus(r runRow, stale time.Duration) string {
+	switch {
+	case r.status == "failed":
+		return "FAILED: " + r.message
+	case r.status == "interrupted":
+		return "INTERRUPTED"
+	case r.status == "running" && time.Since(time.Unix(r.dateEnd, 0)) > stale:
+		return "STALE: no updates since " + time.Unix(r.dateEnd, 0).Format("2006-01-02 15:04")
+	case r.status == "ok" && r.read == 0:
+		return "EMPTY: no lines read"
+	case r.status == "ok" && r.parsed == 0:
+		return "EMPTY: no lines parsed"
+	case r.status == "ok" && r.rejected*2 > r.read:
+		return "MOSTLY REJECTED"
+	}
+	return ""
+}
+
+// runStatusCmd показывает последние запуски прокси. Если последний запуск
+// помечен как неудачный, команда завершается с ошибкой, чтобы её можно было
+// использовать в мониторинге.
+func runStatusCmd(ctx context.Context, cfg *Config) error {
+	store, err := openStore(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if !store.tableExists("scsq_runs") {
+		return fmt.Errorf("Error. No runs recorded yet (table scsq_runs does not exist)")
+	}
+
+	rows, err := store.db.Query(`select id, command, files, status, coalesce(error,''), datestart, dateend,
+		linesread, linesparsed, linesrejected, linesduplicate, linesadded, preparems, insertms, movems, quickms
+	from scsq_runs where numproxy=? order by id desc limit ?`, cfg.NumPrnoxy, cfg.status.last)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var runs []runRow
+	for rows.Next() {
+		var r runRow
+		if err := rows.Scan(&r.id, &r.command, &r.files, &r.status, &r.message, &r.dateStart, &r.dateEnd,
+			&r.read, &r.parsed, &r.rejected, &r.duplicate, &r.added,
+			&r.prepareMs, &r.insertMs, &r.moveMs, &r.quickMs); err != nil {
+			return err
+		}
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	printRuns(os.Stdout, runs, cfg.status.stale)
+	if len(runs) > 0 {
+		if note := runStatus(runs[0], cfg.status.stale); note != "" {
+			return fmt.Errorf("Error. Last run %v: %v", runs[0].id, note)
+		}
+	}
+	return nil
+}
+
+func printRuns(w io.Writer, runs []runRow, stale time.Duration) {
+	if len(runs) == 0 {
+		fmt.Fprintln(w, "No runs")
+		return
+	}
+	fmt.Fprintf(w, "%6v %-16v %10v %-7v %9v %9v %8v %8v %9v %-11v %v\n",
+		"id", "start", "duration", "command", "read", "parsed", "rejected", "dupl", "added", "status", "note")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%6v %-16v %10v %-7v %9v %9v %8v %8v %9v %-11v %v\n",
+			r.id, time.Unix(r.dateStart, 0).Format("2006-01-02 15:04"), time.Duration(r.dateEnd-r.dateStart)*time.Second,
+			r.command, r.read, r.parsed, r.rejected, r.duplicate, r.added, r.status, runStatus(r, stale))
+		log.Debugf("run %v: files %v, phases prepare/insert/move/quick %v/%v/%v/%v ms",
+			r.id, r.files, r.prepareMs, r.insertMs, r.moveMs, r.quickMs)
+	}
+}
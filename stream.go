@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// publisher отправляет разобранные записи потребителям в реальном времени.
+// Publish может буферизовать данные, Flush возвращается только после того,
+// как брокер подтвердил приём всего отправленного.
+type publisher interface {
+	Publish(key string, value []byte) error
+	Flush() error
+	Close() error
+}
+
+type streamRecord struct {
+	Proxy       int    `json:"proxy"`
+	Date        string `json:"date"`
+	IPAddress   string `json:"ipaddress"`
+	HTTPStatus  string `json:"httpstatus"`
+	SizeInBytes string `json:"sizeinbytes"`
+	Method      string `json:"method"`
+	Site        string `json:"site"`
+	Login       string `json:"login"`
+	Mime        string `json:"mime"`
+}
+
+func newPublisher(cfg *Config) (publisher, error) {
+	var dial func() (publisher, error)
+	switch cfg.streamType {
+	case "", "none":
+		return nil, nil
+	case "nats":
+		dial = func() (publisher, error) { return newNATSPublisher(cfg.streamAddr, cfg.streamTopic) }
+	case "kafka":
+		dial = func() (publisher, error) {
+			return newKafkaPublisher(cfg.streamAddr, cfg.streamTopic, cfg.streamFormat), nil
+		}
+	default:
+		return nil, fmt.Errorf("Error. stream must be 'none', 'nats' or 'kafka', not '%v'", cfg.streamType)
+	}
+	pub, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedPublisher{dial: dial, pub: pub, limit: cfg.streamBuffer}, nil
+}
+
+type streamMessage struct {
+	key   string
+	value []byte
+}
+
+// bufferedPublisher хранит записи до подтверждения брокером. Запись в БД от
+// потока не зависит: при обрыве связи записи копятся, а Flush переподключается
+// и отправляет их заново. Пока Flush не прошёл, checkpoint не сдвигается.
+// Больше limit записей не хранится, чтобы долгий обрыв не съел память:
+// лишние теряются для потока (в БД они записаны) и считаются в метриках.
+type bufferedPublisher struct {
+	dial    func() (publisher, error)
+	pub     publisher
+	pending []streamMessage
+	limit   int
+	dropped int
+}
+
+func (p *bufferedPublisher) Publish(key string, value []byte) error {
+	if p.limit > 0 && len(p.pending) >= p.limit {
+		if p.dropped == 0 {
+			log.Warningf("Stream buffer is full (%v records), new records are dropped until the broker is back", p.limit)
+		}
+		p.dropped++
+		metrics.streamDropped()
+		return nil
+	}
+	p.pending = append(p.pending, streamMessage{key: key, value: value})
+	if p.pub == nil {
+		return nil
+	}
+	if err := p.pub.Publish(key, value); err != nil {
+		log.Warningf("Error publish to the stream, records are kept until the next flush:%v", err)
+		p.disconnect()
+	}
+	return nil
+}
+
+func (p *bufferedPublisher) Flush() error {
+	if len(p.pending) == 0 {
+		return nil
+	}
+	if p.pub == nil {
+		pub, err := p.dial()
+		if err != nil {
+			return err
+		}
+		p.pub = pub
+		for _, m := range p.pending {
+			if err := p.pub.Publish(m.key, m.value); err != nil {
+				p.disconnect()
+				return err
+			}
+		}
+		log.Infof("Reconnected to the stream, %v records sent again", len(p.pending))
+	}
+	if err := p.pub.Flush(); err != nil {
+		p.disconnect()
+		return err
+	}
+	if p.dropped > 0 {
+		log.Warningf("%v records were dropped from the stream while the broker was unreachable", p.dropped)
+		p.dropped = 0
+	}
+	p.pending = p.pending[:0]
+	return nil
+}
+
+func (p *bufferedPublisher) disconnect() {
+	p.pub.Close()
+	p.pub = nil
+}
+
+func (p *bufferedPublisher) Close() error {
+	if p.pub == nil {
+		return nil
+	}
+	return p.pub.Close()
+}
+
+func (s *transport) publishLine(v lineOfLogType, cfg *Config) error {
+	if s.pub == nil {
+		return nil
+	}
+	rec := streamRecord{
+		Proxy:       cfg.NumPrnoxy,
+		Date:        v.date,
+		IPAddress:   v.ipaddress,
+		HTTPStatus:  v.httpstatus,
+		SizeInBytes: v.sizeInBytes,
+		Method:      v.method,
+		Site:        v.siteName,
+		Login:       v.login,
+		Mime:        v.mime,
+	}
+	key := rec.IPAddress
+	if cfg.streamKey == "login" {
+		key = rec.Login
+	}
+	value, err := encodeRecord(rec, cfg.streamFormat)
+	if err != nil {
+		return err
+	}
+	return s.pub.Publish(key, value)
+}
+
+func encodeRecord(rec streamRecord, format string) ([]byte, error) {
+	if format == "protobuf" {
+		return rec.marshalProto(), nil
+	}
+	return json.Marshal(rec)
+}
+
+// marshalProto кодирует запись в wire-формат protobuf по схеме:
+//
+//	message SquidRecord {
+//	  int64  proxy       = 1;
+//	  string date        = 2;
+//	  string ipaddress   = 3;
+//	  string httpstatus  = 4;
+//	  string sizeinbytes = 5;
+//	  string method      = 6;
+//	  string site        = 7;
+//	  string login       = 8;
+//	  string mime        = 9;
+//	}
+func (rec streamRecord) marshalProto() []byte {
+	var buf []byte
+	buf = appendVarint(buf, 1<<3|0)
+	buf = appendVarint(buf, uint64(rec.Proxy))
+	for i, str := range []string{rec.Date, rec.IPAddress, rec.HTTPStatus, rec.SizeInBytes, rec.Method, rec.Site, rec.Login, rec.Mime} {
+		if str == "" {
+			continue
+		}
+		buf = appendVarint(buf, uint64(i+2)<<3|2)
+		buf = appendVarint(buf, uint64(len(str)))
+		buf = append(buf, str...)
+	}
+	return buf
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// natsPublisher работает с NATS по текстовому протоколу.
+// Подтверждением служит PONG на PING, отправленный после публикаций:
+// сервер обрабатывает команды по порядку, и до PONG вернёт -ERR, если что-то не так.
+type natsPublisher struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	subject string
+}
+
+func newNATSPublisher(addr, subject string) (*natsPublisher, error) {
+	addr = strings.TrimPrefix(addr, "nats://")
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Error connect to NATS(%v):%v", addr, err)
+	}
+	p := &natsPublisher{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		subject: subject,
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := p.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return nil, fmt.Errorf("Error handshake with NATS(%v):%q %v", addr, info, err)
+	}
+	fmt.Fprint(p.w, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"go-fetch\"}\r\n")
+	if err := p.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *natsPublisher) Publish(key string, value []byte) error {
+	subject := p.subject
+	if key != "" {
+		subject = subject + "." + natsToken(key)
+	}
+	fmt.Fprintf(p.w, "PUB %v %d\r\n", subject, len(value))
+	p.w.Write(value)
+	_, err := p.w.WriteString("\r\n")
+	return err
+}
+
+func (p *natsPublisher) Flush() error {
+	p.w.WriteString("PING\r\n")
+	if err := p.w.Flush(); err != nil {
+		return fmt.Errorf("Error write to NATS:%v", err)
+	}
+	p.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("Error waiting ack from NATS:%v", err)
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "PING"):
+			p.w.WriteString("PONG\r\n")
+			p.w.Flush()
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("Error from NATS:%v", strings.TrimSpace(line))
+		}
+	}
+}
+
+func (p *natsPublisher) Close() error {
+	return p.conn.Close()
+}
+
+// natsToken убирает из ключа символы, недопустимые в токене subject'а NATS.
+func natsToken(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// kafkaPublisher пишет в Kafka через Confluent REST Proxy (API v2).
+// Собственный протокол Kafka не поддерживается.
+// Записи копятся в памяти и уходят одним запросом на Flush;
+// ответ с offset'ами без ошибок считается подтверждением.
+type kafkaPublisher struct {
+	url     string
+	format  string
+	client  *http.Client
+	records []kafkaRecord
+}
+
+type kafkaRecord struct {
+	Key   string      `json:"key,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+func newKafkaPublisher(addr, topic, format string) *kafkaPublisher {
+	return &kafkaPublisher{
+		url:    strings.TrimRight(addr, "/") + "/topics/" + url.PathEscape(topic),
+		format: format,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *kafkaPublisher) Publish(key string, value []byte) error {
+	rec := kafkaRecord{}
+	if p.format == "protobuf" {
+		rec.Key = base64.StdEncoding.EncodeToString([]byte(key))
+		rec.Value = base64.StdEncoding.EncodeToString(value)
+	} else {
+		rec.Key = key
+		rec.Value = json.RawMessage(value)
+	}
+	p.records = append(p.records, rec)
+	return nil
+}
+
+func (p *kafkaPublisher) Flush() error {
+	if len(p.records) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": p.records})
+	if err != nil {
+		return err
+	}
+	contentType := "application/vnd.kafka.json.v2+json"
+	if p.format == "protobuf" {
+		contentType = "application/vnd.kafka.binary.v2+json"
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error send to Kafka REST(%v):%v", p.url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error from Kafka REST(%v): %v %s", p.url, resp.Status, data)
+	}
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("Error parse Kafka REST answer:%v", err)
+	}
+	for _, o := range result.Offsets {
+		if o.ErrorCode != nil {
+			return fmt.Errorf("Error from Kafka: code %v %v", *o.ErrorCode, o.Error)
+		}
+	}
+	p.records = p.records[:0]
+	return nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	return nil
+}
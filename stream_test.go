@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakePublisher запоминает подтверждённые записи, пока down не выставлен.
+type fakePublisher struct {
+	sent  []string
+	acked *[]string
+	down  *bool
+}
+
+func (p *fakePublisher) Publish(key string, value []byte) error {
+	p.sent = append(p.sent, string(value))
+	return nil
+}
+
+func (p *fakePublisher) Flush() error {
+	if *p.down {
+		return errors.New("broker is down")
+	}
+	*p.acked = append(*p.acked, p.sent...)
+	p.sent = nil
+	return nil
+}
+
+func (p *fakePublisher) Close() error { return nil }
+
+func TestBufferedPublisher(t *testing.T) {
+	var acked []string
+	down := false
+	dial := func() (publisher, error) {
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return &fakePublisher{acked: &acked, down: &down}, nil
+	}
+	pub, _ := dial()
+	p := &bufferedPublisher{dial: dial, pub: pub, limit: 3}
+
+	p.Publish("", []byte("a"))
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	down = true
+	for _, v := range []string{"b", "c", "d", "e"} {
+		p.Publish("", []byte(v))
+	}
+	if err := p.Flush(); err == nil {
+		t.Fatal("flush to a down broker succeeded")
+	}
+	if err := p.Flush(); err == nil {
+		t.Fatal("reconnect to a down broker succeeded")
+	}
+	if p.dropped != 1 {
+		t.Errorf("dropped %v, want 1", p.dropped)
+	}
+
+	down = false
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(acked, want) {
+		t.Errorf("acked %v, want %v", acked, want)
+	}
+	if len(p.pending) != 0 || p.dropped != 0 {
+		t.Errorf("pending %v, dropped %v after a flush", len(p.pending), p.dropped)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Поддержка systemd без внешних библиотек: уведомления Type=notify
+// через NOTIFY_SOCKET, watchdog и сокеты из socket activation (LISTEN_FDS).
+// go-fetch читает лог squid только из файла, своих UDP/TCP/syslog приёмников
+// у него нет, поэтому socket activation работает для HTTP: -http-addr и -api-addr.
+
+// sdNotify отправляет состояние в NOTIFY_SOCKET. Вне systemd ничего не делает.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// абстрактный сокет Linux
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdog шлёт WATCHDOG=1 из цикла импорта. Если цикл завис (например,
+// на недоступной БД), heartbeat прекращается и systemd перезапускает сервис.
+type watchdog struct {
+	sync.Mutex
+	interval time.Duration
+	last     time.Time
+}
+
+var heartbeat = &watchdog{}
+
+// setupWatchdog читает WATCHDOG_USEC. Heartbeat отправляется в два раза чаще,
+// чем требует systemd.
+func setupWatchdog(cfg *Config) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	heartbeat = &watchdog{interval: time.Duration(usec) * time.Microsecond / 2}
+	if cfg.follow && heartbeat.interval < cfg.pollInterval {
+		log.Warningf("WatchdogSec=%v is shorter than two poll intervals (%v), the service will be restarted while waiting for new lines",
+			time.Duration(usec)*time.Microsecond, cfg.pollInterval)
+	}
+}
+
+// alive вызывается на каждой строке и каждом ожидании новых строк.
+func (w *watchdog) alive() {
+	if w.interval == 0 {
+		return
+	}
+	w.Lock()
+	due := time.Since(w.last) >= w.interval
+	w.Unlock()
+	if !due {
+		return
+	}
+	st := metrics.status()
+	w.notify(fmt.Sprintf("%.1f lines/sec, read %v, added %v, rejected %v",
+		st.LinesPerSec, st.LinesRead, st.LinesAdded, st.LinesRejected), false)
+}
+
+func (w *watchdog) notify(status string, force bool) {
+	w.Lock()
+	defer w.Unlock()
+	if !force && time.Since(w.last) < w.interval {
+		return
+	}
+	w.last = time.Now()
+	if err := sdNotify("WATCHDOG=1\nSTATUS=" + status); err != nil {
+		log.Warningf("Error sd_notify:%v", err)
+	}
+}
+
+// busy шлёт heartbeat, пока идёт один долгий запрос (перенос в scsq_traffic,
+// пересчёт scsq_quicktraffic), во время которого alive() вызвать негде.
+// Возвращает функцию, которую нужно вызвать по окончании запроса.
+// Зависший запрос watchdog так не заметит, его прервёт обрыв соединения с БД.
+func (w *watchdog) busy(status string) (done func()) {
+	if w.interval == 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	began := time.Now()
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				w.notify(fmt.Sprintf("%v for %.0fs", status, time.Since(began).Seconds()), true)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-finished
+	}
+}
+
+// listenFD - сокет из socket activation и его имя из LISTEN_FDNAMES
+// (FileDescriptorName= в .socket unit'е).
+type listenFD struct {
+	name string
+	file *os.File
+}
+
+// systemdFDs - ещё не отданные сокеты. LISTEN_FDS разбирается один раз,
+// а сокеты раздаются по именам: "http" для -http-addr, "api" для -api-addr.
+var systemdFDs struct {
+	sync.Mutex
+	once  sync.Once
+	files []listenFD
+}
+
+// listenFDs возвращает сокеты, переданные systemd (socket activation).
+// Номера дескрипторов начинаются с 3. Переменные окружения убираются,
+// чтобы их не унаследовали дочерние процессы.
+func listenFDs() []listenFD {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	fds := make([]listenFD, 0, n)
+	for i := 0; i < n; i++ {
+		fd := listenFD{file: os.NewFile(uintptr(3+i), "LISTEN_FD_"+strconv.Itoa(3+i))}
+		if i < len(names) {
+			fd.name = names[i]
+		}
+		fds = append(fds, fd)
+	}
+	return fds
+}
+
+// systemdListener отдаёт сокет из socket activation для name ("http" или "api").
+// Сначала ищется сокет с этим именем, затем первый сокет, не названный
+// именем другого listener'а. Каждый сокет отдаётся один раз.
+func systemdListener(name string) (net.Listener, error) {
+	systemdFDs.Lock()
+	defer systemdFDs.Unlock()
+	systemdFDs.once.Do(func() { systemdFDs.files = listenFDs() })
+
+	pick := -1
+	for i, fd := range systemdFDs.files {
+		if fd.name == name {
+			pick = i
+			break
+		}
+	}
+	if pick < 0 {
+		for i, fd := range systemdFDs.files {
+			if fd.name != "http" && fd.name != "api" {
+				pick = i
+				break
+			}
+		}
+	}
+	if pick < 0 {
+		return nil, fmt.Errorf("Error. -%v-addr systemd, but systemd passed no listening socket for it (LISTEN_FDS, LISTEN_FDNAMES)", name)
+	}
+	fd := systemdFDs.files[pick]
+	systemdFDs.files = append(systemdFDs.files[:pick], systemdFDs.files[pick+1:]...)
+	ln, err := net.FileListener(fd.file)
+	fd.file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error. -%v-addr systemd, socket %v:%v", name, fd.file.Name(), err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenNotify создаёт unix datagram сокет, как NOTIFY_SOCKET у systemd.
+func listenNotify(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	dir := tempDir(t)
+	abstract := fmt.Sprintf("go-fetch-test-%v", os.Getpid())
+	tests := []struct {
+		name   string
+		env    string
+		listen string
+	}{
+		{"path", filepath.Join(dir, "notify"), filepath.Join(dir, "notify")},
+		{"abstract", "@" + abstract, "\x00" + abstract},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := listenNotify(t, tt.listen)
+			setenv(t, "NOTIFY_SOCKET", tt.env)
+			if err := sdNotify("READY=1\nSTATUS=Importing"); err != nil {
+				t.Fatal(err)
+			}
+			if got := readNotify(t, conn); got != "READY=1\nSTATUS=Importing" {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+
+	t.Run("without systemd", func(t *testing.T) {
+		setenv(t, "NOTIFY_SOCKET", "")
+		if err := sdNotify("READY=1"); err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+	})
+	t.Run("no listener", func(t *testing.T) {
+		setenv(t, "NOTIFY_SOCKET", filepath.Join(dir, "missing"))
+		if err := sdNotify("READY=1"); err == nil {
+			t.Error("want an error")
+		}
+	})
+}
+
+func TestWatchdog(t *testing.T) {
+	name := filepath.Join(tempDir(t), "notify")
+	conn := listenNotify(t, name)
+	setenv(t, "NOTIFY_SOCKET", name)
+
+	w := &watchdog{interval: 20 * time.Millisecond}
+	w.alive()
+	if got := readNotify(t, conn); !strings.HasPrefix(got, "WATCHDOG=1\nSTATUS=") {
+		t.Errorf("alive sent %q", got)
+	}
+	// второй вызов в пределах интервала ничего не шлёт
+	w.alive()
+
+	done := w.busy("Filling scsq_quicktraffic")
+	got := readNotify(t, conn)
+	done()
+	if !strings.HasPrefix(got, "WATCHDOG=1\nSTATUS=Filling scsq_quicktraffic for ") {
+		t.Errorf("busy sent %q", got)
+	}
+
+	// без WATCHDOG_USEC ничего не отправляется
+	(&watchdog{}).busy("idle")()
+	(&watchdog{}).alive()
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Errorf("unexpected notification of %v bytes", n)
+	}
+}
+
+func TestListenFDs(t *testing.T) {
+	setenv(t, "LISTEN_PID", "1")
+	setenv(t, "LISTEN_FDS", "1")
+	if files := listenFDs(); files != nil {
+		t.Errorf("sockets of another process were taken: %v", files)
+	}
+
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		file, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		files = append(files, file)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	// LISTEN_PID должен совпасть с PID процесса, поэтому сокеты передаются
+	// дочернему процессу теста, как это делает systemd: дескрипторы 3 и 4.
+	cmd := exec.Command(os.Args[0], "-test.run=TestListenFDsChild")
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), "GO_FETCH_TEST_LISTEN_FDS=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	// сокеты раздаются по именам, а не по порядку вызовов
+	for _, want := range []string{"http on " + addrs[1], "api on " + addrs[0]} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("got %q, want %q", out, want)
+		}
+	}
+}
+
+func TestListenFDsChild(t *testing.T) {
+	if os.Getenv("GO_FETCH_TEST_LISTEN_FDS") != "1" {
+		t.Skip("runs as a child of TestListenFDs")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_FDNAMES", "api:http")
+	for _, name := range []string{"http", "api"} {
+		ln, err := systemdListener(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		fmt.Printf("%v on %v\n", name, ln.Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS is left for child processes")
+	}
+	if _, err := systemdListener("http"); err == nil {
+		t.Error("a socket was handed out twice")
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type verifyOptions struct {
+	period period
+	logs   string
+	repair bool
+}
+
+func verifyFlags(fs *flag.FlagSet, cfg *Config) {
+	periodFlags(fs, &cfg.verify.period, "yesterday", "yesterday")
+	fs.StringVar(&cfg.verify.logs, "log", "/var/log/squid/access.log", "Squid log files to compare with DB, separated by commas")
+	fs.BoolVar(&cfg.verify.repair, "repair", false, "Re-import hours that do not match the logs")
+	fs.IntVar(&cfg.numLines, "nl", 1000, "Number of lines")
+	quarantineFlags(fs, cfg)
+}
+
+// hourStat - число строк и байт за один час.
+type hourStat struct {
+	lines int64
+	bytes int64
+}
+
+type hourReport struct {
+	// hour - начало часа в unix time
+	hour       int64
+	logs       hourStat
+	traffic    hourStat
+	quickBytes int64
+	problem    string
+}
+
+// runVerify сверяет по часам число строк и объём из логов с scsq_traffic
+// и scsq_quicktraffic, а с -repair перезагружает несовпавшие часы.
+func runVerify(ctx context.Context, cfg *Config) error {
+	opts := &cfg.verify
+	if err := opts.period.parse(); err != nil {
+		return err
+	}
+	files := strings.Split(opts.logs, ",")
+
+	store, err := openStore(ctx, cfg, opts.repair)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	from, to := opts.period.from.Unix(), opts.period.to.Unix()
+	fromLogs := make(map[int64]*hourStat)
+	for _, name := range files {
+		if err := scanLogHours(ctx, strings.TrimSpace(name), from, to, func(hour int64, v lineOfLogType) {
+			st, ok := fromLogs[hour]
+			if !ok {
+				st = &hourStat{}
+				fromLogs[hour] = st
+			}
+			st.lines++
+			size, _ := strconv.ParseInt(v.sizeInBytes, 10, 64)
+			st.bytes += size
+		}); err != nil {
+			return err
+		}
+	}
+
+	traffic, quick, err := store.readHourStats(cfg.NumPrnoxy, from, to)
+	if err != nil {
+		return err
+	}
+
+	reports := compareHours(fromLogs, traffic, quick)
+	printHourReports(os.Stdout, reports)
+
+	if !opts.repair {
+		if len(reports) > 0 {
+			return fmt.Errorf("Error. %v hours do not match", len(reports))
+		}
+		return nil
+	}
+
+	// для каждого исправляемого часа - число строк в логах
+	repair := make(map[int64]int64)
+	for _, r := range reports {
+		if r.logs != r.traffic && r.logs.lines > 0 {
+			repair[r.hour] = r.logs.lines
+		}
+	}
+	// Удалённые часы нужно загрузить заново, поэтому исправление
+	// и пересчёт scsq_quicktraffic сигналом не прерываются.
+	if err := store.repairHours(cfg, files, repair); err != nil {
+		return err
+	}
+
+	// scsq_quicktraffic пересчитываем за дни с исправленными или несовпадающими часами
+	days := make(map[time.Time]bool)
+	for _, r := range reports {
+		t := time.Unix(r.hour, 0)
+		days[time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())] = true
+	}
+	for day := range days {
+		if err := store.rebuildQuickTraffic(cfg.NumPrnoxy, day.Unix(), nextDay(day).Unix()); err != nil {
+			return err
+		}
+		log.Infof("Rebuilt scsq_quicktraffic for %v", day.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// scanLogHours вызывает fn для каждой разобранной строки лога из периода [from, to).
+// Час считается по местному времени, как в scsq_quicktraffic.
+func scanLogHours(ctx context.Context, name string, from, to int64, fn func(hour int64, v lineOfLogType)) error {
+	reader, err := openLogReader(name, 0, false)
+	if err != nil {
+		return fmt.Errorf("Error opening squid log file(%v):%v", name, err)
+	}
+	defer reader.Close()
+	for {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		heartbeat.alive()
+		line, err := reader.readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		v, err := parseLineToStruct(replaceQuotes(line))
+		if err != nil {
+			continue
+		}
+		date, _ := strconv.ParseFloat(v.date, 64)
+		if int64(date) < from || int64(date) >= to {
+			continue
+		}
+		v.raw = line
+		v.source = name
+		v.offset = reader.lineStart
+		fn(hourStart(unixToTime(date)).Unix(), v)
+	}
+}
+
+// hourSQL - начало часа по местному времени для столбца с датой строки, те же
+// границы, что у FROM_UNIXTIME(date,'%Y-%m-%d-%H') при заполнении scsq_quicktraffic.
+func hourSQL(column string) string {
+	return "unix_timestamp(from_unixtime(floor(" + column + "),'%Y-%m-%d %H:00:00'))"
+}
+
+func (s *transport) readHourStats(numProxy int, from, to int64) (map[int64]hourStat, map[int64]int64, error) {
+	traffic := make(map[int64]hourStat)
+	rows, err := s.db.Query("select "+hourSQL("date")+" as hour, count(*), coalesce(sum(sizeinbytes),0) from scsq_traffic where date>=? and date<? and numproxy=? group by hour",
+		from, to, numProxy)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hour int64
+		var st hourStat
+		if err := rows.Scan(&hour, &st.lines, &st.bytes); err != nil {
+			return nil, nil, err
+		}
+		traffic[hour] = st
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	quick := make(map[int64]int64)
+	rows2, err := s.db.Query("select "+hourSQL("date")+" as hour, coalesce(sum(sizeinbytes),0) from scsq_quicktraffic where date>=? and date<? and numproxy=? and par=1 group by hour",
+		from, to, numProxy)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var hour, bytes int64
+		if err := rows2.Scan(&hour, &bytes); err != nil {
+			return nil, nil, err
+		}
+		quick[hour] = bytes
+	}
+	return traffic, quick, rows2.Err()
+}
+
+// compareHours возвращает только часы с расхождениями.
+func compareHours(logs map[int64]*hourStat, traffic map[int64]hourStat, quick map[int64]int64) []hourReport {
+	hours := make(map[int64]bool)
+	for h := range logs {
+		hours[h] = true
+	}
+	for h := range traffic {
+		hours[h] = true
+	}
+	for h := range quick {
+		hours[h] = true
+	}
+
+	var reports []hourReport
+	for h := range hours {
+		r := hourReport{hour: h, traffic: traffic[h], quickBytes: quick[h]}
+		if st, ok := logs[h]; ok {
+			r.logs = *st
+		}
+		switch {
+		case r.logs.lines > 0 && r.traffic.lines == 0:
+			r.problem = "missing"
+		case r.logs.lines == 0 && r.traffic.lines > 0:
+			r.problem = "not in logs"
+		case r.traffic.lines > r.logs.lines:
+			r.problem = "duplicates"
+		case r.traffic.lines < r.logs.lines:
+			r.problem = "partially missing"
+		case r.traffic.bytes != r.logs.bytes:
+			r.problem = "bytes mismatch"
+		case r.quickBytes != r.traffic.bytes:
+			r.problem = "quicktraffic mismatch"
+		default:
+			continue
+		}
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].hour < reports[j].hour })
+	return reports
+}
+
+func printHourReports(w io.Writer, reports []hourReport) {
+	if len(reports) == 0 {
+		fmt.Fprintln(w, "All hours match")
+		return
+	}
+	fmt.Fprintf(w, "%-16v %10v %14v %10v %14v %14v  %v\n", "hour", "log lines", "log bytes", "db lines", "db bytes", "quick bytes", "problem")
+	for _, r := range reports {
+		fmt.Fprintf(w, "%-16v %10v %14v %10v %14v %14v  %v\n",
+			time.Unix(r.hour, 0).Format("2006-01-02 15:04"),
+			r.logs.lines, r.logs.bytes, r.traffic.lines, r.traffic.bytes, r.quickBytes, r.problem)
+	}
+}
+
+// repairHours загружает строки указанных часов из логов заново. Сначала строки
+// пишутся в scsq_temptraffic, и только если час прочитан целиком, его строки
+// в scsq_traffic заменяются новыми в одной транзакции. hours - число строк
+// каждого часа, найденное при сверке.
+func (s *transport) repairHours(cfg *Config, files []string, hours map[int64]int64) error {
+	if len(hours) == 0 {
+		return nil
+	}
+	var err error
+	s.quar, err = newQuarantine(cfg, s.db)
+	if err != nil {
+		return err
+	}
+	if err := s.clearTempTraffic(cfg.NumPrnoxy); err != nil {
+		return err
+	}
+
+	batch := cfg.numLines
+	if batch <= 0 {
+		batch = 1000
+	}
+	var (
+		lines    []lineOfLogType
+		errDB    error
+		read     = make(map[int64]int64)
+		from, to = cfg.verify.period.from.Unix(), cfg.verify.period.to.Unix()
+	)
+	flush := func() {
+		if _, err := s.writeArrayToDB(lines, cfg); errors.Is(err, errDBUnavailable) {
+			errDB = err
+		} else if err != nil {
+			log.Warningf("Error in s.writeArrayToDB:%v", err)
+		}
+		lines = nil
+	}
+	for _, name := range files {
+		if err := scanLogHours(context.Background(), strings.TrimSpace(name), from, to, func(hour int64, v lineOfLogType) {
+			if _, ok := hours[hour]; !ok || errDB != nil {
+				return
+			}
+			read[hour]++
+			lines = append(lines, v)
+			if len(lines) >= batch {
+				flush()
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	flush()
+	if errDB != nil {
+		// scsq_traffic не тронута, загруженное в scsq_temptraffic очистит следующий запуск
+		return errDB
+	}
+
+	var repaired, skipped []int64
+	for hour, want := range hours {
+		if read[hour] != want {
+			log.Warningf("Hour %v: %v lines read instead of %v, the log has changed, the hour is not repaired",
+				time.Unix(hour, 0).Format("2006-01-02 15:04"), read[hour], want)
+			skipped = append(skipped, hour)
+			continue
+		}
+		repaired = append(repaired, hour)
+	}
+	err = s.moveTempTrafficTx(cfg, func(tx *sql.Tx) error {
+		for _, hour := range skipped {
+			if _, err := tx.Exec("delete from scsq_temptraffic where date>=? and date<? and numproxy=?",
+				hour, hour+3600, cfg.NumPrnoxy); err != nil {
+				return err
+			}
+		}
+		for _, hour := range repaired {
+			if _, err := tx.Exec("delete from scsq_traffic where date>=? and date<? and numproxy=?",
+				hour, hour+3600, cfg.NumPrnoxy); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Re-imported %v lines for %v hours, %v hours skipped", cfg.lineAdded, len(repaired), len(skipped))
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompareHours(t *testing.T) {
+	h1 := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local).Unix()
+	h2, h3, h4 := h1+3600, h1+2*3600, h1+3*3600
+	tests := []struct {
+		name    string
+		logs    map[int64]*hourStat
+		traffic map[int64]hourStat
+		quick   map[int64]int64
+		want    map[int64]string
+	}{
+		{
+			name:    "all match",
+			logs:    map[int64]*hourStat{h1: {10, 1000}},
+			traffic: map[int64]hourStat{h1: {10, 1000}},
+			quick:   map[int64]int64{h1: 1000},
+			want:    map[int64]string{},
+		},
+		{
+			name:    "missing and not in logs",
+			logs:    map[int64]*hourStat{h1: {10, 1000}},
+			traffic: map[int64]hourStat{h2: {5, 500}},
+			quick:   map[int64]int64{h2: 500},
+			want:    map[int64]string{h1: "missing", h2: "not in logs"},
+		},
+		{
+			name:    "duplicates and partially missing",
+			logs:    map[int64]*hourStat{h1: {10, 1000}, h2: {10, 1000}},
+			traffic: map[int64]hourStat{h1: {12, 1200}, h2: {8, 800}},
+			quick:   map[int64]int64{h1: 1200, h2: 800},
+			want:    map[int64]string{h1: "duplicates", h2: "partially missing"},
+		},
+		{
+			name:    "bytes and quicktraffic",
+			logs:    map[int64]*hourStat{h3: {10, 1000}, h4: {10, 1000}},
+			traffic: map[int64]hourStat{h3: {10, 999}, h4: {10, 1000}},
+			quick:   map[int64]int64{h3: 999, h4: 0},
+			want:    map[int64]string{h3: "bytes mismatch", h4: "quicktraffic mismatch"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := compareHours(tt.logs, tt.traffic, tt.quick)
+			got := map[int64]string{}
+			for i, r := range reports {
+				if i > 0 && reports[i-1].hour >= r.hour {
+					t.Errorf("reports are not sorted by hour: %v", reports)
+				}
+				got[r.hour] = r.problem
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHourStart(t *testing.T) {
+	tests := []struct {
+		in, want time.Time
+	}{
+		{time.Date(2026, 10, 19, 10, 59, 59, 999, time.Local), time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)},
+		{time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local), time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		if got := hourStart(tt.in); !got.Equal(tt.want) {
+			t.Errorf("hourStart(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	// границы часов по местному времени, как у FROM_UNIXTIME в scsq_quicktraffic,
+	// а не date/3600 по UTC: в поясе +05:30 они не совпадают
+	loc := time.FixedZone("IST", 5*3600+1800)
+	in := time.Date(2026, 10, 19, 10, 15, 0, 0, loc)
+	if got := hourStart(in); got.Unix()%3600 == 0 || got.Minute() != 0 {
+		t.Errorf("hourStart(%v) = %v is not the local hour", in, got)
+	}
+}